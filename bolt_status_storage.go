@@ -0,0 +1,261 @@
+package gosmsc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var (
+	boltMessagesBucket = []byte("messages")
+	boltPendingBucket  = []byte("pending") // Keys of the messages for which MessageStatus.IsPending is true
+)
+
+// BoltStorageOptions contains optional MessageStatusBoltStorage settings.
+type BoltStorageOptions struct {
+	// Retention is the time during which messages are kept after they stop being pending, counted from
+	// MessageStatus.StatusUpdatedAt. Zero means completed messages are never removed.
+	Retention time.Duration
+
+	// CompactInterval is the interval of removing completed messages exceeding Retention. Zero disables
+	// automatic compaction, Compact can be called instead.
+	CompactInterval time.Duration
+
+	// Timeout of opening the file, which is locked by another process. Zero means waiting indefinitely.
+	OpenTimeout time.Duration
+}
+
+// MessageStatusBoltStorage is a StatusContainer stored in a bbolt file, for single-node deployments with no
+// database server. Every Put is a transaction synced to the disk, so the file stays consistent after a crash.
+// Pending messages are indexed in a separate bucket.
+//
+// Messages are identified by their id, phone and gateway, see RecipientStatusContainer.
+type MessageStatusBoltStorage struct {
+	db   *bolt.DB
+	opts BoltStorageOptions
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+func NewMessageStatusBoltStorage(path string, opts *BoltStorageOptions) (*MessageStatusBoltStorage, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path is empty")
+	}
+	if opts == nil {
+		opts = new(BoltStorageOptions)
+	}
+	if opts.Retention < 0 || opts.CompactInterval < 0 || opts.OpenTimeout < 0 {
+		return nil, fmt.Errorf("Retention, CompactInterval and OpenTimeout cannot be negative")
+	}
+	if opts.CompactInterval > 0 && opts.Retention == 0 {
+		return nil, fmt.Errorf("CompactInterval requires Retention")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: opts.OpenTimeout})
+	if err != nil {
+		return nil, logger.Error(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltMessagesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltPendingBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, logger.Error(err)
+	}
+
+	ms := &MessageStatusBoltStorage{db: db, opts: *opts, stop: make(chan bool)}
+	if opts.CompactInterval > 0 {
+		ms.wg.Add(1)
+		go ms.compactLoop()
+	}
+	return ms, nil
+}
+
+// Close stops the compaction and closes the file.
+func (ms *MessageStatusBoltStorage) Close() error {
+	close(ms.stop)
+	ms.wg.Wait()
+	return ms.db.Close()
+}
+
+// boltMessageKey returns the key ordered by the message id, then by the phone and then by the gateway.
+func boltMessageKey(message *MessageStatus) []byte {
+	return boltGatewayKey(message.MessageId, message.Phone, message.Gateway)
+}
+
+func boltGatewayKey(messageId int64, phone string, gateway string) []byte {
+	return append(boltRecipientPrefix(messageId, phone), gateway...)
+}
+
+// boltRecipientPrefix returns the prefix of the keys of the messages with the id and phone.
+func boltRecipientPrefix(messageId int64, phone string) []byte {
+	key := make([]byte, 8, 8+len(phone)+1)
+	binary.BigEndian.PutUint64(key, uint64(messageId))
+	key = append(key, phone...)
+	return append(key, 0)
+}
+
+// Get returns the recipient of the message with the least phone.
+func (ms *MessageStatusBoltStorage) Get(messageId int64) (*MessageStatus, error) {
+	logger.Tracef("messageId: '%d'", messageId)
+	return ms.first(boltRecipientPrefix(messageId, "")[:8])
+}
+
+// GetRecipient returns the status of a message sent to several recipients or through several gateways for one of them.
+func (ms *MessageStatusBoltStorage) GetRecipient(messageId int64, phone string, gateway string) (*MessageStatus, error) {
+	logger.Tracef("messageId: '%d', phone: '%s', gateway: '%s'", messageId, phone, gateway)
+	key := boltGatewayKey(messageId, phone, gateway)
+	return ms.find(func(c *bolt.Cursor) ([]byte, []byte) {
+		k, v := c.Seek(key)
+		if !bytes.Equal(k, key) {
+			return nil, nil
+		}
+		return k, v
+	})
+}
+
+// first returns the message with the least key starting with the prefix.
+func (ms *MessageStatusBoltStorage) first(prefix []byte) (*MessageStatus, error) {
+	return ms.find(func(c *bolt.Cursor) ([]byte, []byte) {
+		k, v := c.Seek(prefix)
+		if !bytes.HasPrefix(k, prefix) {
+			return nil, nil
+		}
+		return k, v
+	})
+}
+
+// find returns the message found by the seek func, which returns nil key if there is none.
+func (ms *MessageStatusBoltStorage) find(seek func(c *bolt.Cursor) ([]byte, []byte)) (*MessageStatus, error) {
+	message := new(MessageStatus)
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		key, value := seek(tx.Bucket(boltMessagesBucket).Cursor())
+		if key == nil {
+			return MessageNotFound
+		}
+		return json.Unmarshal(value, message)
+	})
+	if err != nil {
+		if err == MessageNotFound {
+			return nil, err
+		}
+		return nil, logger.Error(err)
+	}
+	return message, nil
+}
+
+func (ms *MessageStatusBoltStorage) Put(message *MessageStatus) error {
+	if message == nil {
+		return logger.Errorf("message is nil")
+	}
+	logger.Tracef("message id: '%d'", message.MessageId)
+
+	value, err := json.Marshal(message)
+	if err != nil {
+		return logger.Error(err)
+	}
+	key := boltMessageKey(message)
+	err = ms.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltMessagesBucket).Put(key, value); err != nil {
+			return err
+		}
+		pending := tx.Bucket(boltPendingBucket)
+		if message.IsPending() {
+			return pending.Put(key, nil)
+		}
+		return pending.Delete(key)
+	})
+	if err != nil {
+		return logger.Error(err)
+	}
+	return nil
+}
+
+// GetPending returns messages for which MessageStatus.IsPending is true, ordered by id.
+func (ms *MessageStatusBoltStorage) GetPending() ([]MessageStatus, error) {
+	logger.Trace("")
+
+	var messages []MessageStatus
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		all := tx.Bucket(boltMessagesBucket)
+		return tx.Bucket(boltPendingBucket).ForEach(func(key, _ []byte) error {
+			var message MessageStatus
+			if err := json.Unmarshal(all.Get(key), &message); err != nil {
+				return err
+			}
+			messages = append(messages, message)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, logger.Error(err)
+	}
+	return messages, nil
+}
+
+// Compact removes the completed messages which were updated before the Retention and returns their number.
+// Freed space is reused by new messages, the file doesn't shrink.
+func (ms *MessageStatusBoltStorage) Compact() (int, error) {
+	if ms.opts.Retention == 0 {
+		return 0, nil
+	}
+	minUpdatedAt := time.Now().Add(-ms.opts.Retention)
+
+	removed := 0
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(boltPendingBucket)
+		c := tx.Bucket(boltMessagesBucket).Cursor()
+		for key, value := c.First(); key != nil; {
+			if pending.Get(key) == nil {
+				var message MessageStatus
+				if err := json.Unmarshal(value, &message); err != nil {
+					return err
+				}
+				if message.StatusUpdatedAt.Before(minUpdatedAt) {
+					// Next may skip a key after Delete, so the cursor is moved to the key following the deleted one by Seek.
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					removed++
+					key, value = c.Seek(key)
+					continue
+				}
+			}
+			key, value = c.Next()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, logger.Error(err)
+	}
+	return removed, nil
+}
+
+func (ms *MessageStatusBoltStorage) compactLoop() {
+	defer ms.wg.Done()
+
+	ticker := time.NewTicker(ms.opts.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ms.stop:
+			return
+		case <-ticker.C:
+			removed, err := ms.Compact()
+			if err != nil {
+				logger.Errorf("Compaction failed: '%s'", err)
+				continue
+			}
+			logger.Debugf("Compaction removed %d messages", removed)
+		}
+	}
+}
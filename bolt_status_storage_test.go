@@ -0,0 +1,110 @@
+package gosmsc
+
+import (
+	. "github.com/goodsign/gosmsc/contract"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBoltStorage(t *testing.T, opts *BoltStorageOptions) (*MessageStatusBoltStorage, string) {
+	dir, err := ioutil.TempDir("", "gosmsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "messages.db")
+	storage, err := NewMessageStatusBoltStorage(path, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return storage, path
+}
+
+func TestBoltStorage(t *testing.T) {
+	storage, path := newTestBoltStorage(t, nil)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := storage.Get(1); err != MessageNotFound {
+		t.Fatalf("Expected MessageNotFound. Got '%v'", err)
+	}
+	message := NewUnknownMessageStatus(1, "79000000001")
+	message.Options = &SendOptions{Sender: "sender"}
+	if err := storage.Put(message); err != nil {
+		t.Fatal(err)
+	}
+	storage.Put(NewUnknownMessageStatus(1, "79000000002"))
+	storage.Put(NewUnknownMessageStatus(2, "79000000001"))
+
+	delivered := NewUnknownMessageStatus(1, "79000000002")
+	delivered.StatusCode = MessageStatusComplete
+	storage.Put(delivered)
+
+	got, err := storage.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Phone != message.Phone || got.Options == nil || got.Options.Sender != "sender" {
+		t.Fatalf("Stored message differs. Expected '%v'. Got '%v'", message, got)
+	}
+	if got, err = storage.GetRecipient(1, "79000000002", ""); err != nil || got.StatusCode != MessageStatusComplete {
+		t.Fatalf("Expected delivered recipient. Got '%v', '%v'", got, err)
+	}
+
+	// The file is reopened to check that the messages and the pending index are persisted.
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	storage, err = NewMessageStatusBoltStorage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	pending, err := storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].MessageId != 1 || pending[0].Phone != "79000000001" || pending[1].MessageId != 2 {
+		t.Fatalf("Expected 2 pending messages. Got '%v'", pending)
+	}
+}
+
+func TestBoltStorageCompaction(t *testing.T) {
+	storage, path := newTestBoltStorage(t, &BoltStorageOptions{Retention: time.Hour})
+	defer os.RemoveAll(filepath.Dir(path))
+	defer storage.Close()
+
+	for i := int64(1); i <= 4; i++ {
+		message := NewUnknownMessageStatus(i, "79000000001")
+		if i != 4 {
+			message.StatusCode = MessageStatusComplete
+		}
+		if i <= 2 || i == 4 {
+			message.StatusUpdatedAt = time.Now().Add(-2 * time.Hour)
+		}
+		storage.Put(message)
+	}
+
+	removed, err := storage.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("Expected %d removed messages. Got '%d'", 2, removed)
+	}
+	if _, err = storage.Get(2); err != MessageNotFound {
+		t.Fatalf("Expected old completed message to be removed. Got '%v'", err)
+	}
+	for _, id := range []int64{3, 4} {
+		if _, err = storage.Get(id); err != nil {
+			t.Fatalf("Expected message %d to be kept. Got '%v'", id, err)
+		}
+	}
+
+	if _, err = NewMessageStatusBoltStorage(path+"2", &BoltStorageOptions{CompactInterval: time.Minute}); err == nil {
+		t.Fatalf("Expected CompactInterval without Retention to be refused")
+	}
+}
@@ -0,0 +1,176 @@
+package gosmsc
+
+import (
+	"context"
+	"errors"
+	. "github.com/goodsign/gosmsc/contract"
+	phonenum "github.com/goodsign/gosmsc/phone"
+	"github.com/goodsign/gosmsc/segment"
+)
+
+// SendBulk sends messages to many recipients, batching them into gateway calls of up to BulkBatchSize
+// recipients if the sender implements BulkSender, or sending them one by one otherwise. Results are
+// returned in the order of messages.
+//
+// Phones are normalized, invalid ones get ErrInvalidPhoneFormat wrapping phone.ErrInvalidPhone without
+// calling the gateway, like in Send. Texts longer than MaxParts get ErrInvalidParameters wrapping
+// ErrTooManyParts. Results contain the normalized phones. Gateway errors are returned per recipient. If
+// a request fails for another reason (e.g. a network error or a cancelled context), sending stops and the
+// results collected so far are returned along with the error: recipients of the failed and following
+// batches have zero Id and nil Error.
+//
+// If track flag is set, every sent recipient is added to the storage.
+func (c *SenderCheckerImpl) SendBulk(messages []BulkMessage, track bool, opts *SendOptions) ([]BulkSendResult, error) {
+	return c.SendBulkContext(context.Background(), messages, track, opts)
+}
+
+func (c *SenderCheckerImpl) SendBulkContext(ctx context.Context, messages []BulkMessage, track bool, opts *SendOptions) ([]BulkSendResult, error) {
+	if err := validateSendOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := c.checkBalance(ctx); err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	// Recipients with invalid phones are skipped, the rest are sent with normalized phones.
+	results := make([]BulkSendResult, len(messages))
+	valid := make([]BulkMessage, 0, len(messages))
+	validResults := make([]*BulkSendResult, 0, len(messages))
+	for i, m := range messages {
+		normalized, err := phonenum.Normalize(m.Phone)
+		if err != nil {
+			results[i] = BulkSendResult{Phone: m.Phone, Error: ErrInvalidPhoneFormat.Wrap(err)}
+			continue
+		}
+		if _, err = c.checkParts(m.Text); err != nil {
+			results[i] = BulkSendResult{Phone: normalized, Error: ErrInvalidParameters.Wrap(err)}
+			continue
+		}
+		results[i].Phone = normalized
+		valid = append(valid, BulkMessage{Phone: normalized, Text: m.Text})
+		validResults = append(validResults, &results[i])
+	}
+	sent, err := c.sendValidBulk(ctx, valid, track, opts)
+	for i := range sent {
+		*validResults[i] = sent[i]
+	}
+	return results, err
+}
+
+// sendValidBulk sends the messages with normalized phones.
+func (c *SenderCheckerImpl) sendValidBulk(ctx context.Context, messages []BulkMessage, track bool, opts *SendOptions) ([]BulkSendResult, error) {
+	results := make([]BulkSendResult, len(messages))
+	for i, m := range messages {
+		results[i].Phone = m.Phone
+	}
+
+	batchSize := c.opts.BulkBatchSize
+	if batchSize == 0 {
+		batchSize = DefaultBulkBatchSize
+	}
+	bulkSender, ok := c.sender.(BulkSender)
+	if !ok {
+		batchSize = 1
+	}
+
+	for start := 0; start < len(messages); start += batchSize {
+		end := start + batchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		var err error
+		if ok {
+			err = c.sendBatch(ctx, bulkSender, messages[start:end], opts, results[start:end])
+		} else {
+			err = c.sendSingle(ctx, &messages[start], opts, results[start:end])
+		}
+		if err != nil {
+			return results, err
+		}
+		if track {
+			if err = c.trackRecipients(messages[start:end], results[start:end], opts); err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// sendBatch sends the messages in one gateway call and fills their results.
+func (c *SenderCheckerImpl) sendBatch(ctx context.Context, sender BulkSender, messages []BulkMessage, opts *SendOptions,
+	results []BulkSendResult) error {
+	output, err := sender.SendBulkContext(ctx, messages, opts)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	if err = output.Err(); err != nil {
+		// The whole batch was refused.
+		setBulkError(results, err)
+		return nil
+	}
+
+	// Result phones are normalized, the gateway may return them in another format.
+	phoneErrors := make(map[string]string)
+	for _, p := range output.Phones {
+		if len(p.Error) == 0 {
+			continue
+		}
+		phone := p.Phone
+		if normalized, err := phonenum.Normalize(phone); err == nil {
+			phone = normalized
+		}
+		phoneErrors[phone] = p.Error
+	}
+	for i := range results {
+		if msg, failed := phoneErrors[results[i].Phone]; failed {
+			results[i].Error = NewSmscError(0, msg)
+			continue
+		}
+		results[i].Id = output.Id
+	}
+	return nil
+}
+
+// sendSingle sends one message and fills its result.
+func (c *SenderCheckerImpl) sendSingle(ctx context.Context, message *BulkMessage, opts *SendOptions, results []BulkSendResult) error {
+	output, err := sendWithOptionsContext(ctx, c.sender, message.Phone, message.Text, opts)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	if err = output.Err(); err != nil {
+		setBulkError(results, err)
+		return nil
+	}
+	results[0].Id = output.Id
+	results[0].Gateway = output.Gateway
+	return nil
+}
+
+// setBulkError sets the gateway error to the results.
+func setBulkError(results []BulkSendResult, err error) {
+	smscErr := NewSmscError(0, err.Error())
+	errors.As(err, &smscErr)
+	for i := range results {
+		results[i].Error = smscErr
+	}
+}
+
+// trackRecipients adds the sent recipients to the storage.
+func (c *SenderCheckerImpl) trackRecipients(messages []BulkMessage, results []BulkSendResult, opts *SendOptions) error {
+	for i, r := range results {
+		if r.Id == 0 {
+			continue
+		}
+		st := NewUnknownMessageStatus(r.Id, r.Phone)
+		st.Options = opts
+		st.Parts = int32(segment.Analyze(messages[i].Text).PartCount())
+		st.Gateway = r.Gateway
+		if err := c.storage.Put(st); err != nil {
+			return logger.Error(err)
+		}
+	}
+	return nil
+}
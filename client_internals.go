@@ -1,70 +1,380 @@
 package gosmsc
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	. "github.com/goodsign/gosmsc/contract"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultSmscBaseUrl = "https://smsc.ru/"
+
+	smscDateLayout = "02.01.2006 15:04:05" // Layout of the dates returned by the gateway
 )
 
 // smsClientInternal contains protocol-independent logic to connect to smsc service or its mock (used in tests).
 type smsClientInternal struct {
-	opts *SmscClientOptions
+	opts     *SmscClientOptions
+	baseUrl  string
+	client   *http.Client
+	redactor *strings.Replacer // Hides credentials in everything that goes to the log
+	limiter  *tokenBucket      // Nil if requests rate is not limited
+}
+
+// gatewayResponse is implemented by all gateway response types.
+type gatewayResponse interface {
+	Err() error // Returns the error returned by the gateway in the response
 }
 
 func newSmsClientInternal(opts *SmscClientOptions) (*smsClientInternal, error) {
-	if len(opts.User) == 0 {
-		return nil, fmt.Errorf("Nil length user")
+	if opts == nil {
+		return nil, fmt.Errorf("Nil options")
+	}
+	if err := opts.validateCredentials(); err != nil {
+		return nil, err
+	}
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("Negative timeout")
 	}
-	if len(opts.Password) == 0 {
-		return nil, fmt.Errorf("Nil length password")
+	if opts.RequestsPerSecond < 0 {
+		return nil, fmt.Errorf("Negative requests rate")
 	}
-	return &smsClientInternal{opts}, nil
+
+	baseUrl := opts.BaseUrl
+	if len(baseUrl) == 0 {
+		baseUrl = DefaultSmscBaseUrl
+	}
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
+
+	var limiter *tokenBucket
+	if opts.RequestsPerSecond > 0 {
+		limiter = newTokenBucket(opts.RequestsPerSecond, opts.Burst)
+	}
+
+	return &smsClientInternal{opts, baseUrl, newHttpClient(opts), newCredentialsRedactor(opts), limiter}, nil
 }
 
-func (c *smsClientInternal) get(path string) ([]byte, error) {
-	getPath := fmt.Sprintf("https://smsc.ru/%s", path)
-	logger.Infof("GET: '%s'", getPath)
-	resp, err := http.Get(getPath)
+// newHttpClient creates the http client used to call the gateway. A caller-supplied client
+// is used as is, otherwise a new one is created from the transport, timeout and TLS settings.
+func newHttpClient(opts *SmscClientOptions) *http.Client {
+	if opts.HttpClient != nil {
+		return opts.HttpClient
+	}
+
+	transport := opts.Transport
+	if transport == nil && (opts.TLSConfig != nil || opts.InsecureSkipVerify) {
+		tlsConfig := new(tls.Config)
+		if opts.TLSConfig != nil {
+			tlsConfig = opts.TLSConfig.Clone()
+		}
+		if opts.InsecureSkipVerify {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: opts.Timeout}
+}
+
+// post sends the form values to the gateway path. Values are sent in the request body, so
+// they are neither limited by the url length nor visible in proxy logs.
+func (c *smsClientInternal) post(ctx context.Context, path string, values url.Values) ([]byte, error) {
+	postPath := c.baseUrl + path
+	logger.Infof("POST: '%s'", c.redact(postPath))
+	logger.Tracef("Parameters: '%s'", c.redact(redactValues(values)))
+	req, err := http.NewRequestWithContext(ctx, "POST", postPath, strings.NewReader(values.Encode()))
 	if err != nil {
-		return nil, logger.Error(err)
+		logger.Error(c.redact(err.Error()))
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		logger.Error(c.redact(err.Error()))
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	respBytes, err := ioutil.ReadAll(resp.Body)
-	logger.Debugf("Server response:\n %s", string(respBytes))
+	logger.Debugf("Server response:\n %s", c.redact(string(respBytes)))
 	if err != nil {
-		return nil, logger.Error(err)
+		logger.Error(c.redact(err.Error()))
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = &httpStatusError{resp.StatusCode}
+		logger.Error(err)
+		return nil, err
 	}
 	return respBytes, nil
 }
 
-func (c *smsClientInternal) Send(phone string, text string) (*SendSMSResponse, error) {
-	respBytes, err := c.get(fmt.Sprintf("sys/send.php?login=%s&psw=%s&charset=utf-8&phones=%s&mes=%s&fmt=3",
-		c.opts.User, c.opts.Password, phone, text))
-	if err != nil {
-		return nil, logger.Error(err)
+// call posts the values to the gateway path and decodes the response into a new output. Transport errors
+// and retryable gateway errors are retried according to the retry policy. Each attempt waits for the rate
+// limiter. If attempts are exhausted on a gateway error, the last response is returned with nil error.
+func (c *smsClientInternal) call(ctx context.Context, path string, values url.Values, newOutput func() gatewayResponse) (gatewayResponse, error) {
+	return c.callRetrying(ctx, path, values, newOutput, false)
+}
+
+// callSend is call for requests sending messages. They are retried only on errors proving that the message
+// wasn't sent, see IsResendableError.
+func (c *smsClientInternal) callSend(ctx context.Context, path string, values url.Values, newOutput func() gatewayResponse) (gatewayResponse, error) {
+	return c.callRetrying(ctx, path, values, newOutput, true)
+}
+
+func (c *smsClientInternal) callRetrying(ctx context.Context, path string, values url.Values, newOutput func() gatewayResponse,
+	send bool) (gatewayResponse, error) {
+	for attempt := 1; ; attempt++ {
+		output, err := c.callOnce(ctx, path, values, newOutput())
+		retryErr := err
+		if err == nil {
+			retryErr = output.Err()
+		}
+		if retryErr == nil || !c.shouldRetry(attempt, retryErr, send) {
+			return output, err
+		}
+
+		backoff := c.opts.Retry.Backoff(attempt)
+		logger.Warnf("Attempt %d failed: '%s'. Retrying in %v", attempt, c.redact(retryErr.Error()), backoff)
+		if err = sleepContext(ctx, backoff); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	output := new(SendSMSResponse)
-	err = json.Unmarshal(respBytes, &output)
+func (c *smsClientInternal) shouldRetry(attempt int, err error, send bool) bool {
+	return c.opts.Retry != nil && attempt < c.opts.Retry.MaxAttempts && c.opts.Retry.isRetryable(err, send)
+}
+
+func (c *smsClientInternal) callOnce(ctx context.Context, path string, values url.Values, output gatewayResponse) (gatewayResponse, error) {
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	respBytes, err := c.post(ctx, path, values)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(respBytes, output)
 	if err != nil {
 		return nil, logger.Error(err)
 	}
 	return output, nil
 }
 
+// redact hides credentials in the string before it is logged.
+func (c *smsClientInternal) redact(s string) string {
+	return c.redactor.Replace(s)
+}
+
+// values returns the parameters common to all gateway calls.
+func (c *smsClientInternal) values() url.Values {
+	v := c.opts.authValues()
+	v.Set("charset", "utf-8")
+	v.Set("fmt", "3")
+	return v
+}
+
+func (c *smsClientInternal) Send(phone string, text string) (*SendSMSResponse, error) {
+	return c.SendContext(context.Background(), phone, text)
+}
+
+func (c *smsClientInternal) SendContext(ctx context.Context, phone string, text string) (*SendSMSResponse, error) {
+	return c.SendWithOptionsContext(ctx, phone, text, nil)
+}
+
+func (c *smsClientInternal) SendWithOptionsContext(ctx context.Context, phone string, text string, opts *SendOptions) (*SendSMSResponse, error) {
+	if err := validateSendOptions(opts); err != nil {
+		return nil, err
+	}
+	v := c.values()
+	v.Set("phones", phone)
+	v.Set("mes", text)
+	setSendOptions(v, opts)
+	output, err := c.callSend(ctx, "sys/send.php", v, func() gatewayResponse { return new(SendSMSResponse) })
+	if err != nil {
+		return nil, err
+	}
+	return output.(*SendSMSResponse), nil
+}
+
+// SendBulkContext sends the messages in one request. Messages with the same text are sent using the phones
+// list, different texts are sent using the 'list' parameter. Per-phone results are requested with 'op=1'.
+func (c *smsClientInternal) SendBulkContext(ctx context.Context, messages []BulkMessage, opts *SendOptions) (*SendBulkResponse, error) {
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("No messages")
+	}
+	if err := validateSendOptions(opts); err != nil {
+		return nil, err
+	}
+	v := c.values()
+	if sameText(messages) {
+		phones := make([]string, len(messages))
+		for i, m := range messages {
+			phones[i] = m.Phone
+		}
+		v.Set("phones", strings.Join(phones, ","))
+		v.Set("mes", messages[0].Text)
+	} else {
+		lines := make([]string, len(messages))
+		for i, m := range messages {
+			// Line breaks inside the text are escaped, because they separate the list items.
+			lines[i] = m.Phone + ":" + strings.Replace(m.Text, "\n", "\\n", -1)
+		}
+		v.Set("list", strings.Join(lines, "\n"))
+	}
+	v.Set("op", "1")
+	setSendOptions(v, opts)
+	output, err := c.callSend(ctx, "sys/send.php", v, func() gatewayResponse { return new(SendBulkResponse) })
+	if err != nil {
+		return nil, err
+	}
+	return output.(*SendBulkResponse), nil
+}
+
+func sameText(messages []BulkMessage) bool {
+	for _, m := range messages[1:] {
+		if m.Text != messages[0].Text {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *smsClientInternal) Balance() (*BalanceResponse, error) {
+	return c.BalanceContext(context.Background())
+}
+
+func (c *smsClientInternal) BalanceContext(ctx context.Context) (*BalanceResponse, error) {
+	output, err := c.call(ctx, "sys/balance.php", c.values(), func() gatewayResponse { return new(BalanceResponse) })
+	if err != nil {
+		return nil, err
+	}
+	return output.(*BalanceResponse), nil
+}
+
+func (c *smsClientInternal) EstimateCost(phone string, text string) (*CostResponse, error) {
+	return c.EstimateCostContext(context.Background(), phone, text)
+}
+
+// EstimateCostContext requests the cost of the message. The message is not sent.
+func (c *smsClientInternal) EstimateCostContext(ctx context.Context, phone string, text string) (*CostResponse, error) {
+	v := c.values()
+	v.Set("phones", phone)
+	v.Set("mes", text)
+	v.Set("cost", "1")
+	output, err := c.call(ctx, "sys/send.php", v, func() gatewayResponse { return new(CostResponse) })
+	if err != nil {
+		return nil, err
+	}
+	return output.(*CostResponse), nil
+}
+
 func (c *smsClientInternal) FetchStatus(id int64, phone string) (*CheckStatusResponse, error) {
-	respBytes, err := c.get(fmt.Sprintf("sys/status.php?login=%s&psw=%s&phone=%s&id=%v&fmt=3&all=2&charset=utf-8",
-		c.opts.User, c.opts.Password, phone, id))
+	return c.FetchStatusContext(context.Background(), id, phone)
+}
+
+func (c *smsClientInternal) FetchStatusContext(ctx context.Context, id int64, phone string) (*CheckStatusResponse, error) {
+	v := c.values()
+	v.Set("phone", phone)
+	v.Set("id", strconv.FormatInt(id, 10))
+	v.Set("all", "2")
+	output, err := c.call(ctx, "sys/status.php", v, func() gatewayResponse { return new(CheckStatusResponse) })
 	if err != nil {
-		return nil, logger.Error(err)
+		return nil, err
+	}
+	return output.(*CheckStatusResponse), nil
+}
+
+// unmarshalListOrFailure unmarshals the server response to a list request. The server returns an array
+// on success or a single object if the whole request failed.
+func unmarshalListOrFailure(data []byte, list interface{}, failure interface{}) error {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		return json.Unmarshal(data, list)
 	}
-	output := new(CheckStatusResponse)
-	err = json.Unmarshal(respBytes, &output)
+	return json.Unmarshal(data, failure)
+}
+
+// checkStatusBatchResponse is used to unmarshal server response for batch status request.
+type checkStatusBatchResponse struct {
+	statuses []CheckStatusResponse
+	failure  CheckStatusResponse
+}
+
+func (r *checkStatusBatchResponse) UnmarshalJSON(data []byte) error {
+	return unmarshalListOrFailure(data, &r.statuses, &r.failure)
+}
+
+func (r *checkStatusBatchResponse) Err() error {
+	return r.failure.Err()
+}
+
+func (c *smsClientInternal) FetchStatusBatch(ctx context.Context, requests []StatusRequest) ([]CheckStatusResponse, error) {
+	ids := make([]string, len(requests))
+	phones := make([]string, len(requests))
+	for i, r := range requests {
+		ids[i] = strconv.FormatInt(r.Id, 10)
+		phones[i] = r.Phone
+	}
+	v := c.values()
+	v.Set("phone", strings.Join(phones, ","))
+	v.Set("id", strings.Join(ids, ","))
+	v.Set("all", "2")
+	output, err := c.call(ctx, "sys/status.php", v, func() gatewayResponse { return new(checkStatusBatchResponse) })
 	if err != nil {
-		return nil, logger.Error(err)
+		return nil, err
 	}
-	return output, nil
+	if err = output.Err(); err != nil {
+		return nil, err
+	}
+	return output.(*checkStatusBatchResponse).statuses, nil
+}
+
+// incomingResponse is used to unmarshal server response for the 'get answers' request.
+type incomingResponse struct {
+	messages []IncomingSMSResponse
+	failure  struct {
+		Error     string `json:"error"`
+		ErrorCode int32  `json:"error_code"`
+	}
+}
+
+func (r *incomingResponse) UnmarshalJSON(data []byte) error {
+	return unmarshalListOrFailure(data, &r.messages, &r.failure)
+}
+
+func (r *incomingResponse) Err() error {
+	if len(r.failure.Error) == 0 && r.failure.ErrorCode == 0 {
+		return nil
+	}
+	return NewSmscError(r.failure.ErrorCode, r.failure.Error)
+}
+
+func (c *smsClientInternal) FetchIncoming(ctx context.Context, afterId int64) ([]IncomingSMSResponse, error) {
+	v := c.values()
+	v.Set("get_answers", "1")
+	if afterId > 0 {
+		v.Set("after_id", strconv.FormatInt(afterId, 10))
+	}
+	output, err := c.call(ctx, "sys/get.php", v, func() gatewayResponse { return new(incomingResponse) })
+	if err != nil {
+		return nil, err
+	}
+	if err = output.Err(); err != nil {
+		return nil, err
+	}
+	return output.(*incomingResponse).messages, nil
 }
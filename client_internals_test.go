@@ -0,0 +1,482 @@
+package gosmsc
+
+import (
+	"context"
+	"errors"
+	. "github.com/goodsign/gosmsc/contract"
+	"github.com/goodsign/gosmsc/phone"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway is a local http server mimicking the smsc.ru gateway. Each incoming request
+// is recorded and answered with the configured response body.
+type fakeGateway struct {
+	*httptest.Server
+	m        sync.Mutex
+	requests []*http.Request
+	response string
+}
+
+func newFakeGateway(response string) *fakeGateway {
+	g := &fakeGateway{response: response}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		g.m.Lock()
+		g.requests = append(g.requests, r)
+		resp := g.response
+		g.m.Unlock()
+		w.Write([]byte(resp))
+	}))
+	return g
+}
+
+func (g *fakeGateway) setResponse(response string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.response = response
+}
+
+func (g *fakeGateway) lastRequest() *http.Request {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if len(g.requests) == 0 {
+		return nil
+	}
+	return g.requests[len(g.requests)-1]
+}
+
+type countingTransport struct {
+	m     sync.Mutex
+	count int
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	t.count++
+	t.m.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestClientUsesBaseUrl(t *testing.T) {
+	g := newFakeGateway(`{"id":42,"cnt":1}`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := c.Send("79211234567", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Id != 42 {
+		t.Fatalf("Expected id = '42'. Got '%d'", output.Id)
+	}
+	r := g.lastRequest()
+	if r == nil {
+		t.Fatal("Gateway wasn't called")
+	}
+	if r.URL.Path != "/sys/send.php" {
+		t.Fatalf("Expected path = '/sys/send.php'. Got '%s'", r.URL.Path)
+	}
+
+	g.setResponse(`{"status":1,"last_date":"02.01.2006 15:04:05"}`)
+	status, err := c.FetchStatus(42, "79211234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.StatusCode != 1 {
+		t.Fatalf("Expected status = '1'. Got '%d'", status.StatusCode)
+	}
+	if r = g.lastRequest(); r.URL.Path != "/sys/status.php" {
+		t.Fatalf("Expected path = '/sys/status.php'. Got '%s'", r.URL.Path)
+	}
+	if id := r.PostForm.Get("id"); id != "42" {
+		t.Fatalf("Expected id = '42'. Got '%s'", id)
+	}
+}
+
+func TestClientUsesTransport(t *testing.T) {
+	g := newFakeGateway(`{"id":1,"cnt":1}`)
+	defer g.Close()
+
+	tr := new(countingTransport)
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL, Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Send("79211234567", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if tr.count != 1 {
+		t.Fatalf("Expected transport to be used once. Got '%d'", tr.count)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	g := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Send("79211234567", "test"); err == nil {
+		t.Fatal("Expected to get timeout error. Got: nil.")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	g := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = c.FetchStatusContext(ctx, 1, "79211234567"); err == nil {
+		t.Fatal("Expected to get deadline error. Got: nil.")
+	}
+}
+
+func TestSendEncoding(t *testing.T) {
+	g := newFakeGateway(`{"id":1,"cnt":1}`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "p&ss=w#rd+", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	texts := []string{
+		"a & b",
+		"#hashtag and ?query=1",
+		"1 + 1 = 2",
+		"  leading and trailing spaces  ",
+		"Привет, мир! Ваш код: 1234",
+		"100% готово; line\nbreak",
+		strings.Repeat("Длинное сообщение & more ", 300),
+	}
+	for _, text := range texts {
+		if _, err = c.Send("+7 921 123 45 67", text); err != nil {
+			t.Fatal(err)
+		}
+		r := g.lastRequest()
+		if r.Method != "POST" {
+			t.Fatalf("Expected method = 'POST'. Got '%s'", r.Method)
+		}
+		if len(r.URL.RawQuery) != 0 {
+			t.Fatalf("Expected empty query. Got '%s'", r.URL.RawQuery)
+		}
+		if mes := r.PostForm.Get("mes"); mes != text {
+			t.Fatalf("Expected text = '%s'. Got '%s'", text, mes)
+		}
+		if phones := r.PostForm.Get("phones"); phones != "+7 921 123 45 67" {
+			t.Fatalf("Expected phones = '+7 921 123 45 67'. Got '%s'", phones)
+		}
+		if psw := r.PostForm.Get("psw"); psw != "p&ss=w#rd+" {
+			t.Fatalf("Expected psw = 'p&ss=w#rd+'. Got '%s'", psw)
+		}
+	}
+}
+
+func TestClientAuthModes(t *testing.T) {
+	g := newFakeGateway(`{"id":1,"cnt":1}`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "secret", HashPassword: true, BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Send("79211234567", "test"); err != nil {
+		t.Fatal(err)
+	}
+	// md5("secret")
+	if psw := g.lastRequest().PostForm.Get("psw"); psw != "5ebe2294ecd0e0f08eab7690d2a6ee69" {
+		t.Fatalf("Expected hashed password. Got '%s'", psw)
+	}
+
+	c, err = newSmsClientInternal(&SmscClientOptions{ApiKey: "key", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Send("79211234567", "test"); err != nil {
+		t.Fatal(err)
+	}
+	form := g.lastRequest().PostForm
+	if form.Get("apikey") != "key" || len(form.Get("login")) != 0 || len(form.Get("psw")) != 0 {
+		t.Fatalf("Expected only api key credentials. Got '%s'", form.Encode())
+	}
+
+	if _, err = newSmsClientInternal(&SmscClientOptions{User: "user"}); err == nil {
+		t.Fatal("Expected to get error for missing password. Got: nil.")
+	}
+}
+
+func TestCredentialsRedaction(t *testing.T) {
+	opts := &SmscClientOptions{User: "user", Password: "s3cr&t", ApiKey: "k3y"}
+	c, err := newSmsClientInternal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := c.redact("psw=s3cr%26t&apikey=k3y&raw=s3cr&t") + " " + redactValues(c.values()) + " " + opts.String()
+	for _, secret := range []string{"s3cr", "k3y"} {
+		if strings.Contains(logged, secret) {
+			t.Fatalf("Secret '%s' is not redacted in '%s'", secret, logged)
+		}
+	}
+}
+
+func TestFetchStatusBatch(t *testing.T) {
+	g := newFakeGateway(`[{"id":1,"phone":"79211234567","status":1},{"id":2,"phone":"79211234568","status":20,"err":1}]`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := c.FetchStatusBatch(context.Background(), []StatusRequest{{Id: 1, Phone: "79211234567"}, {Id: 2, Phone: "79211234568"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || outputs[0].Id != 1 || outputs[1].StatusCode != 20 || outputs[1].StatusErrorCode != 1 {
+		t.Fatalf("Unexpected batch response: '%v'", outputs)
+	}
+	form := g.lastRequest().PostForm
+	if form.Get("id") != "1,2" || form.Get("phone") != "79211234567,79211234568" {
+		t.Fatalf("Unexpected batch request: '%s'", form.Encode())
+	}
+
+	g.setResponse(`{"error":"invalid login","error_code":2}`)
+	if _, err = c.FetchStatusBatch(context.Background(), []StatusRequest{{Id: 1, Phone: "79211234567"}}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrInvalidCredentials, err)
+	}
+}
+
+func TestBalanceAndCost(t *testing.T) {
+	g := newFakeGateway(`{"balance":"123.45","currency":"RUR"}`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newSenderFetcherImplInternal(c, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := f.Balance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Balance != 123.45 || balance.Currency != "RUR" {
+		t.Fatalf("Unexpected balance: '%v'", balance)
+	}
+	if path := g.lastRequest().URL.Path; path != "/sys/balance.php" {
+		t.Fatalf("Expected path = '/sys/balance.php'. Got '%s'", path)
+	}
+
+	g.setResponse(`{"cost":2.5,"cnt":2}`)
+	cost, err := f.EstimateCost("79211234567", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost.Cost != 2.5 || cost.Count != 2 {
+		t.Fatalf("Unexpected cost: '%v'", cost)
+	}
+	if form := g.lastRequest().PostForm; form.Get("cost") != "1" || form.Get("mes") != "test" {
+		t.Fatalf("Unexpected cost request: '%s'", form.Encode())
+	}
+
+	g.setResponse(`{"error":"invalid login","error_code":2}`)
+	if _, err = f.Balance(); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrInvalidCredentials, err)
+	}
+}
+
+func TestMinBalance(t *testing.T) {
+	g := newFakeGateway(`{"balance":"5.00","id":3,"cnt":1}`)
+	defer g.Close()
+
+	opts := &SenderCheckerOptions{MinBalance: 10, BalanceCheckInterval: time.Nanosecond}
+	impl, err := NewSenderCheckerImplWithOptions(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL},
+		newMessageStatusTestStorage(), time.Hour, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	if _, err = impl.Send("79211234567", "test", false); err != ErrBalanceTooLow {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrBalanceTooLow, err)
+	}
+	if path := g.lastRequest().URL.Path; path != "/sys/balance.php" {
+		t.Fatalf("Expected only balance request. Got '%s'", path)
+	}
+
+	g.setResponse(`{"balance":"50.00","id":3,"cnt":1}`)
+	id, err := impl.Send("79211234567", "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 {
+		t.Fatalf("Expected id = '3'. Got '%d'", id)
+	}
+}
+
+func TestBalanceRequestShared(t *testing.T) {
+	var m sync.Mutex
+	balanceCalls := 0
+	g := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sys/balance.php" {
+			m.Lock()
+			balanceCalls++
+			m.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"id":3,"cnt":1}`))
+	}))
+	defer g.Close()
+
+	opts := &SenderCheckerOptions{MinBalance: 10, BalanceCheckInterval: time.Hour}
+	impl, err := NewSenderCheckerImplWithOptions(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL},
+		newMessageStatusTestStorage(), time.Hour, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	// Concurrent sends wait for a single balance request. Its failure doesn't prevent sending.
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := impl.Send("79211234567", "test", false)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The failure is remembered for the check interval.
+	if _, err = impl.Send("79211234567", "test", false); err != nil {
+		t.Fatal(err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if balanceCalls != 1 {
+		t.Fatalf("Expected 1 balance request. Got '%d'", balanceCalls)
+	}
+}
+
+func TestSendOptions(t *testing.T) {
+	g := newFakeGateway(`{"id":5,"cnt":1}`)
+	defer g.Close()
+
+	impl, err := NewSenderCheckerImpl(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL}, newMessageStatusTestStorage(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	opts := &SendOptions{Sender: "Shop", Time: time.Unix(1400000000, 0), Valid: 90 * time.Minute, Translit: true, Flash: true, TinyUrl: true}
+	id, err := impl.SendWithOptions("79211234567", "test", true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := g.lastRequest().PostForm
+	expected := map[string]string{"sender": "Shop", "time": "01400000000", "valid": "01:30", "translit": "1", "flash": "1", "tinyurl": "1"}
+	for k, v := range expected {
+		if form.Get(k) != v {
+			t.Fatalf("Expected %s = '%s'. Got '%s'", k, v, form.Get(k))
+		}
+	}
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.Options == nil || *mstatus.Options != *opts {
+		t.Fatalf("Expected options to be stored. Got '%v'", mstatus.Options)
+	}
+
+	if _, err = impl.SendWithOptions("79211234567", "test", false, &SendOptions{Valid: 25 * time.Hour}); err == nil {
+		t.Fatal("Expected to get invalid validity error. Got: nil.")
+	}
+
+	f, err := newSenderFetcherImplInternal(&smsTestClientInternal{&smscTestClientOptions{}}, &smsTestClientInternal{&smscTestClientOptions{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.SendWithOptions("79211234567", "test", opts); err != ErrNotSupported {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrNotSupported, err)
+	}
+}
+
+func TestSendBulk(t *testing.T) {
+	g := newFakeGateway(`{"id":9,"cnt":1,"phones":[{"phone":"79211234567","cost":"1.5"},{"phone":"79211234568","error":"invalid number"}]}`)
+	defer g.Close()
+
+	storage := newMessageStatusTestStorage()
+	impl, err := NewSenderCheckerImplWithOptions(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL}, storage, time.Hour,
+		&SenderCheckerOptions{BulkBatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	messages := []BulkMessage{{Phone: "+7 921 123-45-67", Text: "hi"}, {Phone: "79211234568", Text: "hi"}, {Phone: "79211234569", Text: "hi\nthere"}}
+	results, err := impl.SendBulk(messages, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Id != 9 || results[1].Id != 0 || results[1].Error == nil || results[2].Id != 9 {
+		t.Fatalf("Unexpected results: '%v'", results)
+	}
+	if len(g.requests) != 2 {
+		t.Fatalf("Expected 2 requests. Got '%d'", len(g.requests))
+	}
+	if form := g.requests[0].PostForm; form.Get("phones") != "+79211234567,+79211234568" || form.Get("op") != "1" {
+		t.Fatalf("Unexpected first request: '%s'", form.Encode())
+	}
+
+	// Both sent recipients of message 9 are tracked.
+	for _, phone := range []string{"+79211234567", "+79211234569"} {
+		if _, err = storage.GetRecipient(9, phone, ""); err != nil {
+			t.Fatalf("Recipient '%s' is not tracked: '%s'", phone, err)
+		}
+	}
+	if _, err = storage.GetRecipient(9, "+79211234568", ""); err != MessageNotFound {
+		t.Fatalf("Expected failed recipient not to be tracked. Got: '%v'", err)
+	}
+
+	messages = []BulkMessage{{Phone: "79211234567", Text: "first"}, {Phone: "12345", Text: "invalid"}, {Phone: "79211234568", Text: "second\nline"}}
+	results, err = impl.SendBulk(messages, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results[1].Error, ErrInvalidPhoneFormat) || !errors.Is(results[1].Error, phone.ErrInvalidPhone) || results[2].Phone != "+79211234568" {
+		t.Fatalf("Unexpected results: '%v'", results)
+	}
+	if list := g.lastRequest().PostForm.Get("list"); list != "+79211234567:first\n+79211234568:second\\nline" {
+		t.Fatalf("Unexpected list: '%s'", list)
+	}
+}
@@ -1,18 +1,102 @@
 package contract
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Status code of a tracked sms message.
 type MessageStatusCode int32
 
+// Status codes returned by smsc.ru (see the gateway http api docs), MessageStatusCodeUnknown used
+// for messages which status wasn't fetched yet and MessageStatusAbandoned set by the tracker.
 const (
-	MessageStatusCodeUnknown = -999
-	MessageStatusJustSent    = -2
-	MessageStatusComplete    = 1
+	MessageStatusCodeUnknown         MessageStatusCode = -999
+	MessageStatusAbandoned           MessageStatusCode = -998 // Tracking age exceeded, message is not polled anymore
+	MessageStatusNotFound            MessageStatusCode = -3   // Message not found by the gateway
+	MessageStatusJustSent            MessageStatusCode = -2
+	MessageStatusWaiting             MessageStatusCode = -1 // Waiting to be sent
+	MessageStatusTransferred         MessageStatusCode = 0  // Transferred to operator
+	MessageStatusComplete            MessageStatusCode = 1  // Delivered
+	MessageStatusRead                MessageStatusCode = 2
+	MessageStatusExpired             MessageStatusCode = 3
+	MessageStatusLinkClicked         MessageStatusCode = 4
+	MessageStatusImpossibleToDeliver MessageStatusCode = 20
+	MessageStatusWrongNumber         MessageStatusCode = 22
+	MessageStatusProhibited          MessageStatusCode = 23
+	MessageStatusInsufficientFunds   MessageStatusCode = 24
+	MessageStatusUnavailableNumber   MessageStatusCode = 25
 )
 
+var messageStatusCodeNames = map[MessageStatusCode]string{
+	MessageStatusCodeUnknown:         "unknown",
+	MessageStatusAbandoned:           "abandoned",
+	MessageStatusNotFound:            "not found",
+	MessageStatusJustSent:            "just sent",
+	MessageStatusWaiting:             "waiting",
+	MessageStatusTransferred:         "transferred to operator",
+	MessageStatusComplete:            "delivered",
+	MessageStatusRead:                "read",
+	MessageStatusExpired:             "expired",
+	MessageStatusLinkClicked:         "link clicked",
+	MessageStatusImpossibleToDeliver: "impossible to deliver",
+	MessageStatusWrongNumber:         "wrong number",
+	MessageStatusProhibited:          "prohibited",
+	MessageStatusInsufficientFunds:   "insufficient funds",
+	MessageStatusUnavailableNumber:   "unavailable number",
+}
+
+func (c MessageStatusCode) String() string {
+	if name, ok := messageStatusCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("status %d", int32(c))
+}
+
+// IsDelivered returns true if the message reached the recipient.
+func (c MessageStatusCode) IsDelivered() bool {
+	switch c {
+	case MessageStatusComplete, MessageStatusRead, MessageStatusLinkClicked:
+		return true
+	}
+	return false
+}
+
+// IsFailed returns true if the message will never be delivered.
+func (c MessageStatusCode) IsFailed() bool {
+	switch c {
+	case MessageStatusNotFound, MessageStatusExpired, MessageStatusImpossibleToDeliver, MessageStatusWrongNumber,
+		MessageStatusProhibited, MessageStatusInsufficientFunds, MessageStatusUnavailableNumber:
+		return true
+	}
+	return false
+}
+
+// IsFinal returns true if the status cannot change anymore (or the library stopped tracking it),
+// so the message doesn't need tracking.
+func (c MessageStatusCode) IsFinal() bool {
+	return c.IsDelivered() || c.IsFailed() || c == MessageStatusAbandoned
+}
+
+// FinalMessageStatusCodes returns all known status codes for which IsFinal is true.
+func FinalMessageStatusCodes() []MessageStatusCode {
+	return []MessageStatusCode{MessageStatusAbandoned, MessageStatusNotFound, MessageStatusComplete, MessageStatusRead, MessageStatusExpired,
+		MessageStatusLinkClicked, MessageStatusImpossibleToDeliver, MessageStatusWrongNumber, MessageStatusProhibited,
+		MessageStatusInsufficientFunds, MessageStatusUnavailableNumber}
+}
+
+// SendOptions contains optional parameters of a sent message. Zero values mean gateway defaults.
+type SendOptions struct {
+	Sender   string        // Sender name registered in the account
+	Time     time.Time     // Scheduled delivery time. Zero means sending immediately
+	Valid    time.Duration // Message lifetime, from 1 minute to 24 hours. The gateway stops delivery attempts after it
+	Translit bool          // Transliterate cyrillic text to latin
+	Flash    bool          // Send as a flash sms, which is displayed immediately and is not saved by the phone
+	TinyUrl  bool          // Replace links in the text with short ones
+}
+
 // MessageStatus represents status of a message that was sent using the smsc service
 // and assigned an ID. MessageStatus can be stored in the database and updated when
 // new information about its status is retrieved from the smsc service.
@@ -24,16 +108,42 @@ type MessageStatus struct {
 	StatusCode      MessageStatusCode
 	Operator        string
 	Region          string
-	StatusErrorCode int32 // Not null if server returned an error code during the last update
+	StatusErrorCode int32        // Not null if server returned an error code during the last update
+	CallbackAt      time.Time    // Time of the last status pushed by the gateway callback. Zero if there were none
+	Options         *SendOptions // Options the message was sent with. Nil if there were none
+	Parts           int32        // Number of sms the text was sent as
+	Gateway         string       // Gateway which sent the message if it was routed by a composite provider
+}
+
+// IsPending returns true if the message needs tracking: its status is not final and the server didn't
+// return an error code during the last update. All StatusContainer implementations and the tracker
+// use this rule to decide which messages are pending.
+func (s *MessageStatus) IsPending() bool {
+	return !s.StatusCode.IsFinal() && s.StatusErrorCode == 0
 }
 
 // NewUnknownMessageStatus creates a new message which status is unknown. E.g. just created message.
 // Unknown status represents status information about the message that was just sent via the sms service,
 // but which code was not retrieved yet.
 func NewUnknownMessageStatus(messageId int64, phone string) *MessageStatus {
-	return &MessageStatus{messageId, phone, time.Now(), time.Now(), MessageStatusCodeUnknown, "", "", 0}
+	return &MessageStatus{messageId, phone, time.Now(), time.Now(), MessageStatusCodeUnknown, "", "", 0, time.Time{}, nil, 0, ""}
 }
 
+// StatusEvent describes a change of a tracked message status (code or error code).
+type StatusEvent struct {
+	MessageId       int64
+	Phone           string
+	Gateway         string // See MessageStatus.Gateway
+	OldStatusCode   MessageStatusCode
+	NewStatusCode   MessageStatusCode
+	Operator        string
+	StatusErrorCode int32
+	Timestamp       time.Time // StatusUpdatedAt of the message after the change
+}
+
+// StatusListener is a func receiving status change events. See MessageTracker.Subscribe.
+type StatusListener func(event StatusEvent)
+
 // CheckStatusResponse is used to unmarshal server response for status checking request.
 type CheckStatusResponse struct {
 	StatusCode      int32  `json:"status"`
@@ -43,6 +153,13 @@ type CheckStatusResponse struct {
 	StatusErrorCode int32  `json:"err"`
 	Error           string `json:"error"`
 	ErrorCode       int32  `json:"error_code"`
+	Id              int64  `json:"id"`    // Filled in batch responses only
+	Phone           string `json:"phone"` // Filled in batch responses only
+}
+
+// Err returns an SmscError if the server returned an error, or nil otherwise.
+func (r *CheckStatusResponse) Err() error {
+	return responseError(r.Error, r.ErrorCode)
 }
 
 // SendSMSResponse is used to unmarshal the response from server on the 'send sms' action.
@@ -51,4 +168,129 @@ type SendSMSResponse struct {
 	Error     string `json:"error"`
 	ErrorCode int32  `json:"error_code"`
 	Id        int64  `json:"id"`
+	Gateway   string `json:"-"` // Gateway which sent the message. Set by composite providers only
+}
+
+// Err returns an SmscError if the server returned an error, or nil otherwise.
+func (r *SendSMSResponse) Err() error {
+	return responseError(r.Error, r.ErrorCode)
+}
+
+// IncomingMessage is an sms sent by a user to the SMSC number, e.g. a reply to a sent message.
+type IncomingMessage struct {
+	Id           int64     // Gateway id of the incoming message
+	Phone        string    // Phone of the user who sent the message
+	ToPhone      string    // SMSC number which received the message
+	Text         string    // Message text
+	ReceivedAt   time.Time // Time the gateway received the message
+	MessageId    int64     // Id of the sent message this one replies to. Zero if the gateway didn't provide it
+	Acknowledged bool      // Set when the message is acknowledged by the application
+}
+
+// IncomingSMSResponse is used to unmarshal an incoming message returned by the server on the 'get answers' action.
+type IncomingSMSResponse struct {
+	Id        int64  `json:"id"`
+	Received  string `json:"received"`
+	Phone     string `json:"phone"`
+	ToPhone   string `json:"to_phone"`
+	Message   string `json:"message"`
+	MessageId int64  `json:"sms_id"` // Id of the sent message this one replies to, if known
+}
+
+// Amount is a money amount. The gateway returns amounts either as numbers or as strings.
+type Amount float64
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	if len(str) == 0 || str == "null" {
+		*a = 0
+		return nil
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid amount '%s'", str)
+	}
+	*a = Amount(v)
+	return nil
+}
+
+// BalanceResponse is used to unmarshal the response from server on the 'balance' action.
+type BalanceResponse struct {
+	Balance   Amount `json:"balance"`
+	Credit    Amount `json:"credit"` // Credit limit of postpaid accounts
+	Currency  string `json:"currency"`
+	Error     string `json:"error"`
+	ErrorCode int32  `json:"error_code"`
+}
+
+// Err returns an SmscError if the server returned an error, or nil otherwise.
+func (r *BalanceResponse) Err() error {
+	return responseError(r.Error, r.ErrorCode)
+}
+
+// CostResponse is used to unmarshal the response from server on the 'send sms' action with cost estimation
+// only (the message is not sent). See SmscClient.EstimateCost.
+type CostResponse struct {
+	Cost      Amount `json:"cost"`
+	Count     int32  `json:"cnt"` // Number of messages (recipients by parts) to be sent
+	Error     string `json:"error"`
+	ErrorCode int32  `json:"error_code"`
+}
+
+// Err returns an SmscError if the server returned an error, or nil otherwise.
+func (r *CostResponse) Err() error {
+	return responseError(r.Error, r.ErrorCode)
+}
+
+// BulkMessage is a message to one recipient of a bulk send.
+type BulkMessage struct {
+	Phone string
+	Text  string
+}
+
+// BulkSendResult is the result of a bulk send for one recipient.
+type BulkSendResult struct {
+	Phone   string
+	Id      int64      // Message id. Recipients of one gateway request share the id. Zero if the message wasn't sent
+	Error   *SmscError // Set if the gateway refused to send the message to the recipient
+	Gateway string     // Gateway which sent the message. Set by composite providers only
+}
+
+// BulkPhoneResponse is used to unmarshal the per-phone part of the response on the 'send sms' action
+// to several recipients.
+type BulkPhoneResponse struct {
+	Phone string `json:"phone"`
+	Cost  Amount `json:"cost"`
+	Error string `json:"error"` // Set if the message cannot be sent to the phone
+}
+
+// SendBulkResponse is used to unmarshal the response from server on the 'send sms' action to several recipients.
+type SendBulkResponse struct {
+	Id        int64               `json:"id"`
+	Count     int32               `json:"cnt"`
+	Phones    []BulkPhoneResponse `json:"phones"`
+	Error     string              `json:"error"`
+	ErrorCode int32               `json:"error_code"`
+}
+
+// Err returns an SmscError if the server returned an error, or nil otherwise.
+func (r *SendBulkResponse) Err() error {
+	return responseError(r.Error, r.ErrorCode)
+}
+
+// SendResult is a provider-neutral result of sending a message. See Provider.
+type SendResult struct {
+	Id      int64  // Message id assigned by the provider
+	Gateway string // Gateway which sent the message. Set by composite providers only
+}
+
+// StatusResult is a provider-neutral message status. See Provider.
+type StatusResult struct {
+	Id              int64
+	Phone           string
+	StatusCode      MessageStatusCode // Provider statuses are mapped to the smsc.ru codes
+	StatusUpdatedAt time.Time         // Zero if the provider doesn't report it
+	Operator        string
+	Region          string
+	StatusErrorCode int32 // Not null if the provider reported an error for the message
 }
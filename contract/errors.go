@@ -0,0 +1,83 @@
+package contract
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SmscError is an error returned by the SMSC gateway in the 'error' and 'error_code' response fields.
+// Use errors.Is with the Err* values to check the code, e.g. errors.Is(err, ErrInsufficientFunds).
+type SmscError struct {
+	Code      int32
+	Message   string
+	Cause     error  `json:"-"`          // Error detected locally, without calling the gateway. Not sent over rpc
+	CauseCode string `json:",omitempty"` // Stable code of the Cause if it is registered by RegisterLocalError
+}
+
+// localErrors are the causes of SmscErrors by their stable codes. See RegisterLocalError.
+var localErrors = make(map[string]error)
+
+// RegisterLocalError registers the stable code of an error detected locally. SmscErrors wrapping the error send
+// the code over rpc instead of the Cause, so errors.Is matches the error on the client side too. It is not safe
+// for concurrent use and is meant to be called from init funcs.
+func RegisterLocalError(code string, err error) {
+	localErrors[code] = err
+}
+
+// Errors documented by the SMSC gateway. Codes 5 and 8 have a different meaning for status requests.
+var (
+	ErrInvalidParameters  = &SmscError{1, "invalid parameters", nil, ""}
+	ErrInvalidCredentials = &SmscError{2, "invalid login or password", nil, ""}
+	ErrInsufficientFunds  = &SmscError{3, "insufficient funds", nil, ""}
+	ErrIpBlocked          = &SmscError{4, "ip address is temporarily blocked", nil, ""}
+	ErrInvalidDateFormat  = &SmscError{5, "invalid date format", nil, ""}
+	ErrMessageProhibited  = &SmscError{6, "message is prohibited", nil, ""}
+	ErrInvalidPhoneFormat = &SmscError{7, "invalid phone number format", nil, ""}
+	ErrCannotDeliver      = &SmscError{8, "message cannot be delivered to the number", nil, ""}
+	ErrTooManyRequests    = &SmscError{9, "too many requests", nil, ""}
+)
+
+// NewSmscError creates an error for the code and message returned by the gateway.
+func NewSmscError(code int32, message string) *SmscError {
+	return &SmscError{code, message, nil, ""}
+}
+
+// Wrap returns an error with the code of e for a problem detected locally, e.g. an invalid phone. errors.Is
+// matches it with both e and the cause.
+func (e *SmscError) Wrap(cause error) *SmscError {
+	causeCode := ""
+	for code, err := range localErrors {
+		if errors.Is(cause, err) {
+			causeCode = code
+			break
+		}
+	}
+	return &SmscError{e.Code, cause.Error(), cause, causeCode}
+}
+
+func (e *SmscError) Error() string {
+	return fmt.Sprintf("[%v] %s", e.Code, e.Message)
+}
+
+// Is reports whether target is an SmscError with the same code. Messages are not compared, because
+// the gateway message text may differ from the one in the Err* values.
+func (e *SmscError) Is(target error) bool {
+	t, ok := target.(*SmscError)
+	return ok && t.Code == e.Code
+}
+
+// Unwrap returns the Cause or, for errors received over rpc, the error registered with the CauseCode.
+func (e *SmscError) Unwrap() error {
+	if e.Cause == nil && len(e.CauseCode) != 0 {
+		return localErrors[e.CauseCode]
+	}
+	return e.Cause
+}
+
+// responseError returns nil if the response has no error fields set, or an SmscError otherwise.
+func responseError(message string, code int32) error {
+	if len(message) == 0 && code == 0 {
+		return nil
+	}
+	return NewSmscError(code, message)
+}
@@ -1,5 +1,9 @@
 package contract
 
+import (
+	"context"
+)
+
 // SenderChecker is an interface representing the ability to perform two main functions: sending sms and tracking them.
 // Tracking here means the ability to poll SMSC gateway periodically.
 //
@@ -15,19 +19,137 @@ type SenderChecker interface {
 	GetActualStatus(id int64) (*MessageStatus, error)
 }
 
+// SenderCheckerContext is a SenderChecker which calls can be cancelled or limited by a deadline using a context.
+// Plain SenderChecker funcs of its implementations are equal to the context funcs called with context.Background().
+type SenderCheckerContext interface {
+	SenderChecker
+
+	SendContext(ctx context.Context, phone string, text string, track bool) (int64, error) // See SenderChecker.Send.
+	GetActualStatusContext(ctx context.Context, id int64) (*MessageStatus, error)          // See SenderChecker.GetActualStatus.
+}
+
+// SenderCheckerWithOptions is a SenderCheckerContext able to send messages with SendOptions.
+type SenderCheckerWithOptions interface {
+	SenderCheckerContext
+
+	// SendWithOptions is the same as SenderChecker.Send, but also accepts optional send parameters. Nil opts are equal to
+	// zero SendOptions. The options are stored with the tracked message status.
+	SendWithOptions(phone string, text string, track bool, opts *SendOptions) (int64, error)
+	SendWithOptionsContext(ctx context.Context, phone string, text string, track bool, opts *SendOptions) (int64, error)
+}
+
 // Sender is an interface representing the ability to send sms using the SMSC gateway.
 type Sender interface {
 	Send(phone string, text string) (*SendSMSResponse, error) // Sends SMS via SMSC. Returns service response.
 }
 
+// SenderContext is an optional extension of Sender supporting cancellation and deadlines.
+// If a Sender doesn't implement it, the context is only checked before the Send call.
+type SenderContext interface {
+	SendContext(ctx context.Context, phone string, text string) (*SendSMSResponse, error) // See Sender.Send.
+}
+
+// AccountFetcher is an optional extension of Sender able to request the account balance and the cost of a
+// message without sending it.
+type AccountFetcher interface {
+	BalanceContext(ctx context.Context) (*BalanceResponse, error)                              // Gets the account balance. Returns service response.
+	EstimateCostContext(ctx context.Context, phone string, text string) (*CostResponse, error) // Gets the message cost. Returns service response.
+}
+
+// SenderWithOptions is an optional extension of Sender able to send messages with SendOptions.
+// If a Sender doesn't implement it, messages with options cannot be sent.
+type SenderWithOptions interface {
+	SendWithOptionsContext(ctx context.Context, phone string, text string, opts *SendOptions) (*SendSMSResponse, error) // See Sender.Send.
+}
+
+// BulkSender is an optional extension of Sender able to send messages to several recipients in one gateway call.
+// If a Sender doesn't implement it, bulk messages are sent one by one.
+type BulkSender interface {
+	// SendBulkContext sends the messages in one call. All recipients get the same message id.
+	SendBulkContext(ctx context.Context, messages []BulkMessage, opts *SendOptions) (*SendBulkResponse, error)
+}
+
 // StatusFetcher is an interface representing the ability to fetch sms status using the SMSC gateway.
 type StatusFetcher interface {
 	FetchStatus(id int64, phone string) (*CheckStatusResponse, error) // Gets current SMS status via SMSC. Returns service response.
 }
 
-// StatusContainer defines contract for tracked sms storage container.
+// StatusFetcherContext is an optional extension of StatusFetcher supporting cancellation and deadlines.
+// If a StatusFetcher doesn't implement it, the context is only checked before the FetchStatus call.
+type StatusFetcherContext interface {
+	FetchStatusContext(ctx context.Context, id int64, phone string) (*CheckStatusResponse, error) // See StatusFetcher.FetchStatus.
+}
+
+// StatusRequest identifies a message which status is requested in a batch.
+type StatusRequest struct {
+	Id    int64
+	Phone string
+}
+
+// BatchStatusFetcher is an optional extension of StatusFetcher able to fetch statuses of several messages
+// in one gateway call. The tracker uses it if available and falls back to FetchStatus otherwise.
+type BatchStatusFetcher interface {
+	// FetchStatusBatch returns statuses of the requested messages. Responses are matched to the requests by
+	// their Id and Phone fields, a message may be missing in the result.
+	FetchStatusBatch(ctx context.Context, requests []StatusRequest) ([]CheckStatusResponse, error)
+}
+
+// GatewayStatusFetcher is an optional extension of StatusFetcher routing messages across several gateways.
+// The tracker uses it to poll messages which MessageStatus.Gateway is set.
+type GatewayStatusFetcher interface {
+	// FetchGatewayStatusContext gets current SMS status from the gateway which sent it.
+	FetchGatewayStatusContext(ctx context.Context, gateway string, id int64, phone string) (*CheckStatusResponse, error)
+}
+
+// StatusContainer defines contract for tracked sms storage container. Messages are identified by their id, phone
+// and gateway, because ids are assigned by gateways and are unique per gateway only.
 type StatusContainer interface {
 	Put(msgStatus *MessageStatus) error      // If status is already present, overwrite it. Overwise adds it.
 	Get(msgId int64) (*MessageStatus, error) // Get status by its id, if present. If not, returns error.
-	GetPending() ([]MessageStatus, error)    // Returns those with status not equal to MessageStatusComplete
+	GetPending() ([]MessageStatus, error)    // Returns those for which MessageStatus.IsPending is true
+}
+
+// IncomingFetcher is an interface representing the ability to fetch sms received by the SMSC number.
+type IncomingFetcher interface {
+	// FetchIncoming returns messages received after the message with the specified id (all available
+	// messages if afterId is zero) in the order of their ids.
+	FetchIncoming(ctx context.Context, afterId int64) ([]IncomingSMSResponse, error)
+}
+
+// IncomingContainer defines contract for received sms storage container.
+type IncomingContainer interface {
+	PutIncoming(message *IncomingMessage) error                                 // Adds the message if it is not present yet. Present messages are left unchanged.
+	GetIncoming(id int64) (*IncomingMessage, error)                             // Get message by its id, if present. If not, returns error.
+	ListIncoming(unacknowledgedOnly bool, limit int) ([]IncomingMessage, error) // Returns messages in the order of receiving. Zero limit means no limit.
+	AcknowledgeIncoming(ids []int64) error                                      // Marks messages as acknowledged. Unknown ids are ignored.
+	LastIncomingId() (int64, error)                                             // Returns the max id of the stored messages or zero if there are none.
+}
+
+// RecipientStatusContainer is an optional extension of StatusContainer for messages sent to several recipients
+// under one id or through several gateways. StatusContainer.Get returns any of such messages.
+type RecipientStatusContainer interface {
+	// GetRecipient gets status by its id, phone and gateway (empty for messages sent without a MultiGatewayProvider),
+	// if present. If not, returns error.
+	GetRecipient(msgId int64, phone string, gateway string) (*MessageStatus, error)
+}
+
+// Provider is a provider-neutral sms gateway. Unlike Sender and StatusFetcher, it returns gateway errors as
+// errors instead of response fields. Use gosmsc.NewSenderCheckerImplWithProvider to send and track messages
+// using any provider.
+type Provider interface {
+	Name() string // Short provider name, e.g. 'smsc'
+
+	// SendMessage sends the message. Nil opts are equal to zero SendOptions, unsupported options are ignored.
+	SendMessage(ctx context.Context, phone string, text string, opts *SendOptions) (*SendResult, error)
+
+	// FetchMessageStatus gets the current status of the message.
+	FetchMessageStatus(ctx context.Context, id int64, phone string) (*StatusResult, error)
+}
+
+// MultiGatewayProvider is a Provider routing messages across several gateways. It sets SendResult.Gateway
+// and is able to fetch the status from the gateway which sent the message.
+type MultiGatewayProvider interface {
+	Provider
+
+	FetchGatewayMessageStatus(ctx context.Context, gateway string, id int64, phone string) (*StatusResult, error) // See Provider.FetchMessageStatus.
 }
@@ -0,0 +1,91 @@
+package gosmsc
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	redactedValue = "***"
+)
+
+// validateCredentials checks that options contain either an api key or a user/password pair.
+func (opts *SmscClientOptions) validateCredentials() error {
+	if len(opts.ApiKey) != 0 {
+		return nil
+	}
+	if len(opts.User) == 0 {
+		return fmt.Errorf("Nil length user")
+	}
+	if len(opts.Password) == 0 {
+		return fmt.Errorf("Nil length password")
+	}
+	return nil
+}
+
+// passwordParam returns the password in the form it is sent to the gateway.
+func (opts *SmscClientOptions) passwordParam() string {
+	if !opts.HashPassword {
+		return opts.Password
+	}
+	sum := md5.Sum([]byte(opts.Password))
+	return hex.EncodeToString(sum[:])
+}
+
+// authValues returns the authentication parameters of a gateway call.
+func (opts *SmscClientOptions) authValues() url.Values {
+	v := url.Values{}
+	if len(opts.ApiKey) != 0 {
+		v.Set("apikey", opts.ApiKey)
+		return v
+	}
+	v.Set("login", opts.User)
+	v.Set("psw", opts.passwordParam())
+	return v
+}
+
+// String returns options description with all secrets redacted, so options can be safely logged.
+func (opts SmscClientOptions) String() string {
+	password, apiKey := "", ""
+	if len(opts.Password) != 0 {
+		password = redactedValue
+	}
+	if len(opts.ApiKey) != 0 {
+		apiKey = redactedValue
+	}
+	return fmt.Sprintf("{User: '%s', Password: '%s', ApiKey: '%s', HashPassword: %v, BaseUrl: '%s', Timeout: %v}",
+		opts.User, password, apiKey, opts.HashPassword, opts.BaseUrl, opts.Timeout)
+}
+
+// newCredentialsRedactor creates a replacer that hides every form of the secrets from the options
+// (plain, md5-hashed and url-escaped) in the strings passed to the log.
+func newCredentialsRedactor(opts *SmscClientOptions) *strings.Replacer {
+	var pairs []string
+	for _, secret := range []string{opts.Password, opts.passwordParam(), opts.ApiKey} {
+		if len(secret) == 0 {
+			continue
+		}
+		pairs = append(pairs, secret, redactedValue)
+		if escaped := url.QueryEscape(secret); escaped != secret {
+			pairs = append(pairs, escaped, redactedValue)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// redactValues encodes values for logging, hiding the credentials.
+func redactValues(values url.Values) string {
+	v := url.Values{}
+	for key, value := range values {
+		switch key {
+		case "psw", "apikey":
+			v.Set(key, redactedValue)
+		default:
+			v[key] = value
+		}
+	}
+	return v.Encode()
+}
@@ -0,0 +1,349 @@
+package gosmsc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultOpenTimeout      = 30 * time.Second
+)
+
+var (
+	ErrNoAvailableGateway = errors.New("No available gateway")
+	ErrUnknownGateway     = errors.New("Unknown gateway")
+)
+
+// FailoverBackend is a gateway used by FailoverProvider.
+type FailoverBackend struct {
+	Provider Provider
+	Name     string // Unique gateway name recorded in MessageStatus.Gateway. Defaults to Provider.Name()
+
+	// Priority orders the backends: a backend is used only if all backends with a smaller Priority
+	// value failed or are unavailable.
+	Priority int
+
+	// Weight is the relative share of messages sent by the backend among the backends with the same
+	// priority. Zero means 1.
+	Weight int
+
+	// Countries limits the backend to phones with the country calling codes, e.g. '7' or '375'.
+	// Empty means all countries.
+	Countries []string
+}
+
+// FailoverOptions contains optional FailoverProvider settings. Zero values mean defaults.
+type FailoverOptions struct {
+	// FailureThreshold is the number of consecutive failures after which the backend circuit is opened
+	// and the backend isn't used during OpenTimeout. After it one trial message is sent, the circuit is
+	// closed if it succeeds or opened again otherwise.
+	FailureThreshold int
+	OpenTimeout      time.Duration
+
+	// ShouldFailover decides if the message is sent by the next backend after the error. Errors for which
+	// it returns true are also counted as backend failures, as well as transport errors like timeouts.
+	// Defaults to IsFailoverError.
+	ShouldFailover func(err error) bool
+}
+
+// GatewayHealth describes the state of a FailoverProvider backend.
+type GatewayHealth struct {
+	Name                string
+	Available           bool // False if the backend circuit is open
+	ConsecutiveFailures int
+	OpenedAt            time.Time // Time the circuit was opened last time
+}
+
+// FailoverProvider is a MultiGatewayProvider sending messages through several backends (e.g. smsc.ru,
+// its regional mirrors and other providers). Each message is sent by the first suitable backend in the
+// order of priorities, with weighted random order among the backends with equal priority. If a backend
+// fails, the message is sent by the next one. Backends failing repeatedly are not used for a while
+// (see FailoverOptions.FailureThreshold).
+//
+// Use it with NewSenderCheckerImplWithProvider: the chosen backend is recorded in MessageStatus.Gateway
+// and the tracker polls the status from it.
+type FailoverProvider struct {
+	opts     FailoverOptions
+	backends []*failoverBackend
+	byName   map[string]*failoverBackend
+	randM    sync.Mutex
+	rand     *rand.Rand
+}
+
+type failoverBackend struct {
+	FailoverBackend
+	m        sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	trial    bool // A trial message is being sent through the open circuit
+}
+
+func NewFailoverProvider(backends []FailoverBackend, opts *FailoverOptions) (*FailoverProvider, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("No backends")
+	}
+	if opts == nil {
+		opts = new(FailoverOptions)
+	}
+	if opts.FailureThreshold < 0 || opts.OpenTimeout < 0 {
+		return nil, fmt.Errorf("FailureThreshold and OpenTimeout cannot be negative")
+	}
+	p := &FailoverProvider{
+		opts:   *opts,
+		byName: make(map[string]*failoverBackend),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if p.opts.FailureThreshold == 0 {
+		p.opts.FailureThreshold = DefaultFailureThreshold
+	}
+	if p.opts.OpenTimeout == 0 {
+		p.opts.OpenTimeout = DefaultOpenTimeout
+	}
+	if p.opts.ShouldFailover == nil {
+		p.opts.ShouldFailover = IsFailoverError
+	}
+	for _, b := range backends {
+		if b.Provider == nil {
+			return nil, fmt.Errorf("Nil backend provider")
+		}
+		if b.Weight < 0 {
+			return nil, fmt.Errorf("Negative weight")
+		}
+		if len(b.Name) == 0 {
+			b.Name = b.Provider.Name()
+		}
+		if _, ok := p.byName[b.Name]; ok {
+			return nil, fmt.Errorf("Duplicate gateway name '%s'", b.Name)
+		}
+		backend := &failoverBackend{FailoverBackend: b}
+		p.backends = append(p.backends, backend)
+		p.byName[b.Name] = backend
+	}
+	return p, nil
+}
+
+// IsFailoverError returns true for errors proving that the gateway refused to send the message because of its
+// own state: refused connections, 5xx responses and the ErrInsufficientFunds, ErrInvalidCredentials and
+// ErrIpBlocked gateway errors. Other errors are either caused by the message and would be the same for any
+// gateway (e.g. ErrInvalidDateFormat), or ambiguous: after a timeout or ErrTooManyRequests the gateway may have
+// sent the message already, so sending it through another gateway would duplicate it.
+func IsFailoverError(err error) bool {
+	for _, e := range []error{ErrInsufficientFunds, ErrInvalidCredentials, ErrIpBlocked} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	var smscErr *SmscError
+	if errors.As(err, &smscErr) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500
+	}
+	var providerErr *HttpProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.HttpStatus >= 500
+	}
+	return isNotDeliveredError(err)
+}
+
+// isTransportFailure returns true for transport errors which are not failover errors, e.g. timeouts. They
+// are counted as backend failures, but the message is not sent through another backend.
+func isTransportFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (p *FailoverProvider) Name() string {
+	return "failover"
+}
+
+// SendMessage sends the message through the first suitable backend which didn't fail. Returns
+// ErrNoAvailableGateway if there are no suitable backends with closed circuits, or the last error
+// if all of them failed.
+func (p *FailoverProvider) SendMessage(ctx context.Context, phone string, text string, opts *SendOptions) (*SendResult, error) {
+	candidates := p.candidates(phone)
+	if len(candidates) == 0 {
+		return nil, ErrNoAvailableGateway
+	}
+	var lastErr error
+	for _, b := range candidates {
+		if !b.acquire(p.opts.OpenTimeout) {
+			continue
+		}
+		result, err := b.Provider.SendMessage(ctx, phone, text, opts)
+		if err == nil {
+			b.report(true, p.opts.FailureThreshold)
+			result.Gateway = b.Name
+			return result, nil
+		}
+		if !p.opts.ShouldFailover(err) {
+			if isTransportFailure(err) {
+				b.report(false, p.opts.FailureThreshold)
+			} else {
+				b.release()
+			}
+			return nil, err
+		}
+		b.report(false, p.opts.FailureThreshold)
+		logger.Warnf("Gateway '%s' failed: '%s'", b.Name, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		return nil, ErrNoAvailableGateway
+	}
+	return nil, lastErr
+}
+
+// FetchMessageStatus returns ErrUnknownGateway: message ids are unique per gateway only, so another
+// gateway could return the status of an unrelated message. Use FetchGatewayMessageStatus.
+func (p *FailoverProvider) FetchMessageStatus(ctx context.Context, id int64, phone string) (*StatusResult, error) {
+	return nil, fmt.Errorf("%w: gateway of message %d is not specified", ErrUnknownGateway, id)
+}
+
+func (p *FailoverProvider) FetchGatewayMessageStatus(ctx context.Context, gateway string, id int64, phone string) (*StatusResult, error) {
+	b, ok := p.byName[gateway]
+	if !ok {
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownGateway, gateway)
+	}
+	return b.Provider.FetchMessageStatus(ctx, id, phone)
+}
+
+// Health returns the state of the backends in the order they were configured.
+func (p *FailoverProvider) Health() []GatewayHealth {
+	health := make([]GatewayHealth, len(p.backends))
+	for i, b := range p.backends {
+		b.m.Lock()
+		health[i] = GatewayHealth{b.Name, !b.open, b.failures, b.openedAt}
+		b.m.Unlock()
+	}
+	return health
+}
+
+// sorted returns the backends ordered by priority.
+func (p *FailoverProvider) sorted() []*failoverBackend {
+	backends := append([]*failoverBackend(nil), p.backends...)
+	sort.SliceStable(backends, func(i, j int) bool {
+		return backends[i].Priority < backends[j].Priority
+	})
+	return backends
+}
+
+// candidates returns the backends serving the phone in the order they are tried: by priority, then in
+// weighted random order.
+func (p *FailoverProvider) candidates(phone string) []*failoverBackend {
+	var candidates []*failoverBackend
+	for _, b := range p.sorted() {
+		if b.serves(phone) {
+			candidates = append(candidates, b)
+		}
+	}
+
+	p.randM.Lock()
+	defer p.randM.Unlock()
+	for start := 0; start < len(candidates); {
+		end := start + 1
+		for end < len(candidates) && candidates[end].Priority == candidates[start].Priority {
+			end++
+		}
+		p.shuffleWeighted(candidates[start:end])
+		start = end
+	}
+	return candidates
+}
+
+// shuffleWeighted orders the backends randomly, a backend is chosen for each position with the probability
+// proportional to its weight.
+func (p *FailoverProvider) shuffleWeighted(backends []*failoverBackend) {
+	for i := range backends {
+		total := 0
+		for _, b := range backends[i:] {
+			total += b.weight()
+		}
+		n := p.rand.Intn(total)
+		for j := i; j < len(backends); j++ {
+			n -= backends[j].weight()
+			if n < 0 {
+				backends[i], backends[j] = backends[j], backends[i]
+				break
+			}
+		}
+	}
+}
+
+func (b *failoverBackend) weight() int {
+	if b.Weight == 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+// serves returns true if the backend sends messages to the phone.
+func (b *failoverBackend) serves(phone string) bool {
+	if len(b.Countries) == 0 {
+		return true
+	}
+	digits := strings.TrimPrefix(phone, "+")
+	for _, code := range b.Countries {
+		if strings.HasPrefix(digits, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire returns true if a message can be sent through the backend. An open circuit lets one
+// trial message through after the timeout.
+func (b *failoverBackend) acquire(openTimeout time.Duration) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < openTimeout {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// release ends the trial without changing the circuit state, e.g. if the error was caused by the message.
+func (b *failoverBackend) release() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.trial = false
+}
+
+// report updates the circuit state after a message was sent through the backend.
+func (b *failoverBackend) report(success bool, threshold int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.trial = false
+	if success {
+		b.failures = 0
+		b.open = false
+		return
+	}
+	b.failures++
+	if b.open || b.failures >= threshold {
+		if !b.open {
+			logger.Warnf("Gateway '%s' circuit opened after %d failures", b.Name, b.failures)
+		}
+		b.open = true
+		b.openedAt = time.Now()
+	}
+}
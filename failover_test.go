@@ -0,0 +1,215 @@
+package gosmsc
+
+import (
+	"context"
+	"errors"
+	. "github.com/goodsign/gosmsc/contract"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testProvider is an in-memory Provider counting sends and status requests.
+type testProvider struct {
+	name    string
+	m       sync.Mutex
+	err     error // Returned by SendMessage if set
+	sent    int
+	fetched int
+}
+
+func (p *testProvider) Name() string {
+	return p.name
+}
+
+func (p *testProvider) SendMessage(ctx context.Context, phone string, text string, opts *SendOptions) (*SendResult, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	p.sent++
+	return &SendResult{Id: getNextMessageId()}, nil
+}
+
+func (p *testProvider) FetchMessageStatus(ctx context.Context, id int64, phone string) (*StatusResult, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.fetched++
+	return &StatusResult{Id: id, Phone: phone, StatusCode: MessageStatusComplete}, nil
+}
+
+func (p *testProvider) setErr(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.err = err
+}
+
+func (p *testProvider) counts() (sent int, fetched int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.sent, p.fetched
+}
+
+func TestFailover(t *testing.T) {
+	primary := &testProvider{name: "primary", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	secondary := &testProvider{name: "secondary"}
+	provider, err := NewFailoverProvider([]FailoverBackend{
+		{Provider: secondary, Priority: 1},
+		{Provider: primary},
+	}, &FailoverOptions{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl, err := NewSenderCheckerImplWithProvider(provider, newMessageStatusTestStorage(), time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	id, err := impl.Send("+7 921 123 45 67", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.Gateway != "secondary" {
+		t.Fatalf("Expected gateway = 'secondary'. Got '%s'", mstatus.Gateway)
+	}
+
+	// The status is fetched from the gateway which sent the message.
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+	if _, fetched := secondary.counts(); fetched != 1 {
+		t.Fatalf("Expected secondary to be polled once. Got '%d'", fetched)
+	}
+	if _, fetched := primary.counts(); fetched != 0 {
+		t.Fatalf("Expected primary not to be polled. Got '%d'", fetched)
+	}
+
+	// The second failure opens the primary circuit.
+	if _, err = impl.Send("+7 921 123 45 67", "test", false); err != nil {
+		t.Fatal(err)
+	}
+	primary.setErr(nil)
+	if _, err = impl.Send("+7 921 123 45 67", "test", false); err != nil {
+		t.Fatal(err)
+	}
+	if sent, _ := primary.counts(); sent != 0 {
+		t.Fatalf("Expected primary not to be used while its circuit is open. Got '%d' sends", sent)
+	}
+	if h := provider.Health(); h[1].Available || h[1].ConsecutiveFailures != 2 {
+		t.Fatalf("Unexpected primary health: '%v'", h[1])
+	}
+
+	// The trial message closes the circuit.
+	time.Sleep(60 * time.Millisecond)
+	if _, err = impl.Send("+7 921 123 45 67", "test", false); err != nil {
+		t.Fatal(err)
+	}
+	if sent, _ := primary.counts(); sent != 1 {
+		t.Fatalf("Expected trial message to be sent by primary. Got '%d' sends", sent)
+	}
+	if h := provider.Health(); !h[1].Available {
+		t.Fatalf("Unexpected primary health: '%v'", h[1])
+	}
+}
+
+func TestFailoverMessageErrors(t *testing.T) {
+	primary := &testProvider{name: "primary", err: ErrMessageProhibited}
+	secondary := &testProvider{name: "secondary"}
+	provider, err := NewFailoverProvider([]FailoverBackend{{Provider: primary}, {Provider: secondary, Priority: 1}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.SendMessage(context.Background(), "+79211234567", "test", nil); err != ErrMessageProhibited {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrMessageProhibited, err)
+	}
+	if sent, _ := secondary.counts(); sent != 0 {
+		t.Fatalf("Expected message error not to fail over. Got '%d' sends", sent)
+	}
+	if h := provider.Health(); h[0].ConsecutiveFailures != 0 {
+		t.Fatalf("Expected message error not to be counted as failure. Got '%v'", h[0])
+	}
+}
+
+func TestNoFailoverOnAmbiguousErrors(t *testing.T) {
+	// Timeouts are counted as backend failures, the other errors are not.
+	opens := map[error]bool{&timeoutError{}: true, ErrTooManyRequests: false, ErrInvalidDateFormat: false}
+	for sendErr, open := range opens {
+		primary := &testProvider{name: "primary", err: sendErr}
+		secondary := &testProvider{name: "secondary"}
+		provider, err := NewFailoverProvider([]FailoverBackend{{Provider: primary}, {Provider: secondary, Priority: 1}},
+			&FailoverOptions{FailureThreshold: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = provider.SendMessage(context.Background(), "+79211234567", "test", nil); err != sendErr {
+			t.Fatalf("Expected to get '%s'. Got: '%v'.", sendErr, err)
+		}
+		if sent, _ := secondary.counts(); sent != 0 {
+			t.Fatalf("Expected '%s' not to fail over. Got '%d' sends", sendErr, sent)
+		}
+		if h := provider.Health(); h[0].Available == open {
+			t.Fatalf("Unexpected primary health after '%s': '%v'", sendErr, h[0])
+		}
+	}
+
+	for _, sendErr := range []error{ErrInsufficientFunds, ErrInvalidCredentials, ErrIpBlocked, &httpStatusError{502},
+		&HttpProviderError{HttpStatus: 503}} {
+		if !IsFailoverError(sendErr) {
+			t.Fatalf("Expected '%s' to fail over", sendErr)
+		}
+	}
+}
+
+func TestFailoverRouting(t *testing.T) {
+	ru := &testProvider{name: "ru"}
+	by := &testProvider{name: "by"}
+	light := &testProvider{name: "light"}
+	heavy := &testProvider{name: "heavy"}
+	provider, err := NewFailoverProvider([]FailoverBackend{
+		{Provider: ru, Countries: []string{"7"}},
+		{Provider: by, Countries: []string{"375"}},
+		{Provider: light, Priority: 1, Weight: 1},
+		{Provider: heavy, Priority: 1, Weight: 1000000},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phone := range []string{"+79211234567", "+375291234567", "+12125550100"} {
+		result, err := provider.SendMessage(context.Background(), phone, "test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"+79211234567": "ru", "+375291234567": "by", "+12125550100": "heavy"}[phone]
+		if result.Gateway != expected {
+			t.Fatalf("Expected '%s' to be sent by '%s'. Got '%s'", phone, expected, result.Gateway)
+		}
+	}
+
+	if _, err = NewFailoverProvider([]FailoverBackend{{Provider: ru}, {Provider: ru}}, nil); err == nil {
+		t.Fatal("Expected to get duplicate name error. Got: nil.")
+	}
+}
+
+func TestFailoverStatusRequiresGateway(t *testing.T) {
+	primary := &testProvider{name: "primary"}
+	provider, err := NewFailoverProvider([]FailoverBackend{{Provider: primary}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.FetchMessageStatus(context.Background(), 1, "+79211234567"); !errors.Is(err, ErrUnknownGateway) {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrUnknownGateway, err)
+	}
+	if _, fetched := primary.counts(); fetched != 0 {
+		t.Fatalf("Expected no status requests without gateway. Got '%d'", fetched)
+	}
+	if _, err = provider.FetchGatewayMessageStatus(context.Background(), "primary", 1, "+79211234567"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,216 @@
+package gosmsc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultHttpProviderName = "http"
+)
+
+// HttpProviderStatuses maps the statuses returned by an HttpProvider to the message status codes.
+// Unknown statuses are mapped to MessageStatusCodeUnknown, so such messages keep being tracked.
+var HttpProviderStatuses = map[string]MessageStatusCode{
+	"accepted":    MessageStatusWaiting,
+	"queued":      MessageStatusWaiting,
+	"sent":        MessageStatusTransferred,
+	"delivered":   MessageStatusComplete,
+	"read":        MessageStatusRead,
+	"expired":     MessageStatusExpired,
+	"undelivered": MessageStatusImpossibleToDeliver,
+	"failed":      MessageStatusImpossibleToDeliver,
+	"rejected":    MessageStatusProhibited,
+}
+
+// HttpProviderOptions configures an HttpProvider.
+type HttpProviderOptions struct {
+	Name      string // Provider name. Defaults to DefaultHttpProviderName
+	SendUrl   string
+	StatusUrl string
+	Token     string // Sent in the 'Authorization: Bearer' header if set
+
+	// Timeout limits the time of each request. Zero means no timeout. Ignored if HttpClient is set.
+	Timeout    time.Duration
+	HttpClient *http.Client
+}
+
+// HttpProvider is a Provider for gateways with a simple JSON http api:
+//
+//   - Send: POST to SendUrl with {"phone", "text", "sender", "send_at" (RFC 3339), "ttl" (seconds),
+//     "translit", "flash"} body. Responds with {"id": <int>}.
+//   - Status: GET StatusUrl?id=<id>&phone=<phone>. Responds with {"status", "updated_at" (RFC 3339),
+//     "operator", "region", "error_code"}, see HttpProviderStatuses for the status values.
+//
+// Errors are returned with a non-2xx http status and an optional {"error": <message>, "code": <int>} body.
+type HttpProvider struct {
+	opts   HttpProviderOptions
+	client *http.Client
+}
+
+// HttpProviderError is returned if the gateway responded with an error.
+type HttpProviderError struct {
+	HttpStatus int
+	Code       int32
+	Message    string
+}
+
+func (e *HttpProviderError) Error() string {
+	return fmt.Sprintf("[%d/%d] %s", e.HttpStatus, e.Code, e.Message)
+}
+
+func NewHttpProvider(opts *HttpProviderOptions) (*HttpProvider, error) {
+	if opts == nil {
+		return nil, fmt.Errorf("Nil options")
+	}
+	for _, u := range []string{opts.SendUrl, opts.StatusUrl} {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("Invalid url '%s': %s", u, err)
+		}
+	}
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("Negative timeout")
+	}
+	client := opts.HttpClient
+	if client == nil {
+		client = &http.Client{Timeout: opts.Timeout}
+	}
+	p := &HttpProvider{*opts, client}
+	if len(p.opts.Name) == 0 {
+		p.opts.Name = DefaultHttpProviderName
+	}
+	return p, nil
+}
+
+func (p *HttpProvider) Name() string {
+	return p.opts.Name
+}
+
+type httpProviderSendRequest struct {
+	Phone    string `json:"phone"`
+	Text     string `json:"text"`
+	Sender   string `json:"sender,omitempty"`
+	SendAt   string `json:"send_at,omitempty"`
+	Ttl      int64  `json:"ttl,omitempty"`
+	Translit bool   `json:"translit,omitempty"`
+	Flash    bool   `json:"flash,omitempty"`
+}
+
+type httpProviderStatusResponse struct {
+	Status    string `json:"status"`
+	UpdatedAt string `json:"updated_at"`
+	Operator  string `json:"operator"`
+	Region    string `json:"region"`
+	ErrorCode int32  `json:"error_code"`
+}
+
+func (p *HttpProvider) SendMessage(ctx context.Context, phone string, text string, opts *SendOptions) (*SendResult, error) {
+	body := httpProviderSendRequest{Phone: phone, Text: text}
+	if opts != nil {
+		body.Sender = opts.Sender
+		if !opts.Time.IsZero() {
+			body.SendAt = opts.Time.Format(time.RFC3339)
+		}
+		body.Ttl = int64(opts.Valid / time.Second)
+		body.Translit = opts.Translit
+		body.Flash = opts.Flash
+	}
+	data, err := json.Marshal(&body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.opts.SendUrl, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var output struct {
+		Id int64 `json:"id"`
+	}
+	if err = p.do(req, &output); err != nil {
+		return nil, err
+	}
+	return &SendResult{Id: output.Id}, nil
+}
+
+func (p *HttpProvider) FetchMessageStatus(ctx context.Context, id int64, phone string) (*StatusResult, error) {
+	u, err := url.Parse(p.opts.StatusUrl)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("id", strconv.FormatInt(id, 10))
+	q.Set("phone", phone)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	output := new(httpProviderStatusResponse)
+	if err = p.do(req, output); err != nil {
+		return nil, err
+	}
+	result := &StatusResult{
+		Id:              id,
+		Phone:           phone,
+		StatusCode:      MessageStatusCodeUnknown,
+		Operator:        output.Operator,
+		Region:          output.Region,
+		StatusErrorCode: output.ErrorCode,
+	}
+	if code, ok := HttpProviderStatuses[output.Status]; ok {
+		result.StatusCode = code
+	} else {
+		logger.Warnf("Unknown status '%s' of message %v", output.Status, id)
+	}
+	if updatedAt, err := time.Parse(time.RFC3339, output.UpdatedAt); err == nil {
+		result.StatusUpdatedAt = updatedAt
+	}
+	return result, nil
+}
+
+// do sends the request and decodes the response into output.
+func (p *HttpProvider) do(req *http.Request, output interface{}) error {
+	if len(p.opts.Token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+p.opts.Token)
+	}
+	logger.Infof("%s: '%s'", req.Method, req.URL.Path)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return logger.Error(err)
+	}
+	logger.Debugf("Server response:\n %s", string(respBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		providerErr := &HttpProviderError{HttpStatus: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		var body struct {
+			Error string `json:"error"`
+			Code  int32  `json:"code"`
+		}
+		if json.Unmarshal(respBytes, &body) == nil && len(body.Error) != 0 {
+			providerErr.Code, providerErr.Message = body.Code, body.Error
+		}
+		logger.Error(providerErr)
+		return providerErr
+	}
+	if err = json.Unmarshal(respBytes, output); err != nil {
+		return logger.Error(err)
+	}
+	return nil
+}
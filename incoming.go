@@ -0,0 +1,218 @@
+package gosmsc
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IncomingPoller periodically fetches the messages received by the SMSC number and puts them to the storage.
+// Only the messages newer than the last polled one are requested. The poller keeps its own cursor, so messages
+// stored by the IncomingCallbackHandler meanwhile don't make it skip the ones it hasn't fetched yet. The cursor
+// starts from the last stored message id.
+type IncomingPoller struct {
+	stopM         sync.Mutex
+	fetcher       IncomingFetcher
+	storage       IncomingContainer
+	lastId        int64 // Polling cursor, used by the polling goroutine only
+	lastIdLoaded  bool
+	tickerForTest chan bool
+	stopped       bool
+	stopChannel   chan bool
+	ctx           context.Context
+	cancel        context.CancelFunc // Aborts the gateway call that is in progress when the poller is stopped
+}
+
+// StartIncomingPolling creates a new poller using its own gateway client and starts polling in a separate
+// goroutine. To stop it, call Stop on the returned poller.
+func StartIncomingPolling(opts *SmscClientOptions, storage IncomingContainer, pollInterval time.Duration) (*IncomingPoller, error) {
+	sint, err := newSmsClientInternal(opts)
+	if err != nil {
+		return nil, err
+	}
+	return startIncomingPollingInternal(sint, storage, pollInterval)
+}
+
+func startIncomingPollingInternal(fetcher IncomingFetcher, storage IncomingContainer, pollInterval time.Duration) (*IncomingPoller, error) {
+	if fetcher == nil {
+		return nil, fmt.Errorf("Incoming poller fetcher cannot be nil")
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("Incoming poller storage cannot be nil")
+	}
+	if pollInterval <= 0 {
+		return nil, fmt.Errorf("pollInterval cannot be zero or negative")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	poller := &IncomingPoller{
+		fetcher:       fetcher,
+		storage:       storage,
+		tickerForTest: make(chan bool),
+		stopChannel:   make(chan bool, 1),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+
+	go func(p *IncomingPoller) {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for !p.IsStopped() {
+			select {
+			case <-p.tickerForTest:
+				p.poll()
+			case <-ticker.C:
+				p.poll()
+			case <-p.stopChannel:
+			}
+		}
+	}(poller)
+
+	return poller, nil
+}
+
+// IsStopped returns true if the poller goroutine was stopped by the Stop func.
+func (p *IncomingPoller) IsStopped() bool {
+	p.stopM.Lock()
+	defer p.stopM.Unlock()
+	return p.stopped
+}
+
+// Stop stops the polling goroutine. A stopped poller cannot be used anymore.
+func (p *IncomingPoller) Stop() error {
+	p.stopM.Lock()
+	defer p.stopM.Unlock()
+	if p.stopped {
+		return fmt.Errorf("Already stopped")
+	}
+	p.stopped = true
+	p.cancel()
+	p.stopChannel <- true
+	close(p.tickerForTest)
+	close(p.stopChannel)
+	return nil
+}
+
+func (p *IncomingPoller) poll() {
+	if !p.lastIdLoaded {
+		lastId, err := p.storage.LastIncomingId()
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		p.lastId, p.lastIdLoaded = lastId, true
+	}
+	outputs, err := p.fetcher.FetchIncoming(p.ctx, p.lastId)
+	if err != nil {
+		logger.Warnf("Incoming messages poll failed: '%s'", err)
+		return
+	}
+	// Outputs may come in any order, the cursor is advanced only if all of them are stored.
+	maxId := p.lastId
+	for i := range outputs {
+		if outputs[i].Id <= p.lastId {
+			continue
+		}
+		if err = p.storage.PutIncoming(newIncomingMessage(&outputs[i])); err != nil {
+			logger.Error(err)
+			return
+		}
+		if outputs[i].Id > maxId {
+			maxId = outputs[i].Id
+		}
+	}
+	p.lastId = maxId
+}
+
+func newIncomingMessage(output *IncomingSMSResponse) *IncomingMessage {
+	// Parsed the same way as the status dates, so receiving and status times are comparable.
+	receivedAt, err := time.Parse(smscDateLayout, output.Received)
+	if err != nil {
+		logger.Warnf("Cannot parse receiving time of incoming message %v: '%s'", output.Id, err)
+		receivedAt = time.Now()
+	}
+	return &IncomingMessage{
+		Id:         output.Id,
+		Phone:      output.Phone,
+		ToPhone:    output.ToPhone,
+		Text:       output.Message,
+		ReceivedAt: receivedAt,
+		MessageId:  output.MessageId,
+	}
+}
+
+// IncomingCallbackHandler receives the messages pushed by SMSC to the incoming sms callback url configured
+// in the account settings, and puts them to the storage.
+//
+// Callbacks are verified by the 'md5' parameter, which SMSC calculates as md5 of 'id:phone:mes:secret'
+// string, where the secret is the account password.
+type IncomingCallbackHandler struct {
+	storage IncomingContainer
+	secret  string
+}
+
+func NewIncomingCallbackHandler(storage IncomingContainer, secret string) (*IncomingCallbackHandler, error) {
+	if storage == nil {
+		return nil, logger.Error("storage cannot be nil")
+	}
+	if len(secret) == 0 {
+		return nil, logger.Error("secret cannot be empty")
+	}
+	return &IncomingCallbackHandler{storage, secret}, nil
+}
+
+func (h *IncomingCallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	phone := r.Form.Get("phone")
+	text := r.Form.Get("mes")
+	if !strings.EqualFold(r.Form.Get("md5"), IncomingCallbackSignature(h.secret, id, phone, text)) {
+		logger.Warnf("Incoming message %v callback has invalid signature", id)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	// Sent message id and receiving time are optional.
+	messageId, _ := strconv.ParseInt(r.Form.Get("sms_id"), 10, 64)
+	receivedAt := time.Now()
+	if ts, err := strconv.ParseInt(r.Form.Get("time"), 10, 64); err == nil && ts > 0 {
+		receivedAt = time.Unix(ts, 0)
+	}
+
+	logger.Debugf("Incoming message %v from '%s'", id, phone)
+	err = h.storage.PutIncoming(&IncomingMessage{
+		Id:         id,
+		Phone:      phone,
+		ToPhone:    r.Form.Get("to"),
+		Text:       text,
+		ReceivedAt: receivedAt,
+		MessageId:  messageId,
+	})
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// IncomingCallbackSignature returns the md5 signature of an incoming message callback.
+func IncomingCallbackSignature(secret string, id int64, phone string, text string) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d:%s:%s:%s", id, phone, text, secret)))
+	return hex.EncodeToString(sum[:])
+}
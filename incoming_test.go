@@ -0,0 +1,94 @@
+package gosmsc
+
+import (
+	"context"
+	. "github.com/goodsign/gosmsc/contract"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchIncoming(t *testing.T) {
+	g := newFakeGateway(`[{"id":7,"received":"05.03.2014 10:20:30","phone":"79211234567","to_phone":"79001234567","message":"Да","sms_id":42}]`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := new(incomingTestStorage)
+	poller, err := startIncomingPollingInternal(c, storage, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop()
+
+	poller.tickerForTest <- false
+	poller.tickerForTest <- false // Returns when the first poll is over
+
+	message, err := storage.GetIncoming(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Text != "Да" || message.MessageId != 42 || message.ToPhone != "79001234567" {
+		t.Fatalf("Unexpected message: '%v'", message)
+	}
+	if !message.ReceivedAt.Equal(time.Date(2014, 3, 5, 10, 20, 30, 0, time.UTC)) {
+		t.Fatalf("Unexpected receiving time: '%v'", message.ReceivedAt)
+	}
+
+	// The next poll requests only the messages after the polled one. The message delivered by a callback
+	// meanwhile doesn't move the cursor.
+	if err = storage.PutIncoming(&IncomingMessage{Id: 20, Phone: "79211234567", Text: "Stop"}); err != nil {
+		t.Fatal(err)
+	}
+	poller.tickerForTest <- false // Returns when the second poll is over
+	r := g.lastRequest()
+	if r.URL.Path != "/sys/get.php" || r.PostForm.Get("get_answers") != "1" || r.PostForm.Get("after_id") != "7" {
+		t.Fatalf("Unexpected request: '%s' '%s'", r.URL.Path, r.PostForm.Encode())
+	}
+
+	g.setResponse(`{"error":"invalid login","error_code":2}`)
+	if _, err = c.FetchIncoming(context.Background(), 0); err == nil {
+		t.Fatal("Expected to get gateway error. Got: nil.")
+	}
+}
+
+func TestIncomingCallback(t *testing.T) {
+	storage := new(incomingTestStorage)
+	h, err := NewIncomingCallbackHandler(storage, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(signature string) int {
+		values := url.Values{
+			"id":     {"11"},
+			"phone":  {"79211234567"},
+			"mes":    {"Stop"},
+			"sms_id": {"42"},
+			"md5":    {signature},
+		}
+		r := httptest.NewRequest("POST", "/incoming", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := post(IncomingCallbackSignature("wrong", 11, "79211234567", "Stop")); code != http.StatusForbidden {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusForbidden, code)
+	}
+	if code := post(IncomingCallbackSignature("secret", 11, "79211234567", "Stop")); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+	messages, err := storage.ListIncoming(true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Text != "Stop" || messages[0].MessageId != 42 {
+		t.Fatalf("Unexpected messages: '%v'", messages)
+	}
+}
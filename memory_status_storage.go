@@ -0,0 +1,278 @@
+package gosmsc
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorageOptions contains optional MemoryStatusStorage settings. Zero values mean no limits.
+type MemoryStorageOptions struct {
+	// MaxMessages limits the number of stored messages. When it is exceeded, the earliest created messages are
+	// evicted, including pending ones.
+	MaxMessages int
+
+	// MaxAge limits the time since message creation during which it is stored. Older messages are evicted.
+	MaxAge time.Duration
+}
+
+// MemoryStatusStorage is a concurrency-safe in-memory StatusContainer. Pending messages are indexed, so
+// GetPending doesn't scan all messages. The content can be saved to a file and restored, e.g. on restart.
+//
+// Messages are identified by their id, phone and gateway, see RecipientStatusContainer. Eviction is done on Put.
+type MemoryStatusStorage struct {
+	m       sync.RWMutex
+	opts    MemoryStorageOptions
+	seq     uint64
+	order   *list.List                            // Messages ordered by CreatedAt. Values are *memoryEntry
+	byId    map[int64]map[memoryKey]*list.Element // Messages by id, phone and gateway
+	pending map[*list.Element]bool                // Messages for which MessageStatus.IsPending is true
+}
+
+type memoryKey struct {
+	phone   string
+	gateway string
+}
+
+type memoryEntry struct {
+	message *MessageStatus
+	seq     uint64 // Order of adding
+}
+
+func NewMemoryStatusStorage(opts *MemoryStorageOptions) (*MemoryStatusStorage, error) {
+	if opts == nil {
+		opts = new(MemoryStorageOptions)
+	}
+	if opts.MaxMessages < 0 || opts.MaxAge < 0 {
+		return nil, fmt.Errorf("MaxMessages and MaxAge cannot be negative")
+	}
+	s := &MemoryStatusStorage{opts: *opts}
+	s.reset()
+	return s, nil
+}
+
+func (s *MemoryStatusStorage) reset() {
+	s.order = list.New()
+	s.byId = make(map[int64]map[memoryKey]*list.Element)
+	s.pending = make(map[*list.Element]bool)
+}
+
+// Get returns the first added recipient of the message.
+func (s *MemoryStatusStorage) Get(messageId int64) (*MessageStatus, error) {
+	return s.first(messageId, func(key memoryKey) bool { return true })
+}
+
+// GetRecipient returns the message with the id, phone and gateway.
+func (s *MemoryStatusStorage) GetRecipient(messageId int64, phone string, gateway string) (*MessageStatus, error) {
+	return s.first(messageId, func(key memoryKey) bool { return key.phone == phone && key.gateway == gateway })
+}
+
+func (s *MemoryStatusStorage) first(messageId int64, match func(key memoryKey) bool) (*MessageStatus, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	var first *memoryEntry
+	for key, e := range s.byId[messageId] {
+		if entry := e.Value.(*memoryEntry); match(key) && (first == nil || entry.seq < first.seq) {
+			first = entry
+		}
+	}
+	if first == nil {
+		return nil, MessageNotFound
+	}
+	return copyMessageStatus(first.message), nil
+}
+
+func (s *MemoryStatusStorage) Put(message *MessageStatus) error {
+	if message == nil {
+		return logger.Errorf("message is nil")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.put(copyMessageStatus(message))
+	s.evict()
+	return nil
+}
+
+func (s *MemoryStatusStorage) put(message *MessageStatus) {
+	recipients, ok := s.byId[message.MessageId]
+	if !ok {
+		recipients = make(map[memoryKey]*list.Element)
+		s.byId[message.MessageId] = recipients
+	}
+	key := memoryKey{message.Phone, message.Gateway}
+	e, ok := recipients[key]
+	if ok {
+		e.Value.(*memoryEntry).message = message
+	} else {
+		s.seq++
+		e = s.order.PushBack(&memoryEntry{message, s.seq})
+		recipients[key] = e
+	}
+	s.place(e)
+	if message.IsPending() {
+		s.pending[e] = true
+	} else {
+		delete(s.pending, e)
+	}
+}
+
+// GetPending returns the pending messages in the order they were added.
+func (s *MemoryStatusStorage) GetPending() ([]MessageStatus, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	entries := make([]*memoryEntry, 0, len(s.pending))
+	for e := range s.pending {
+		entries = append(entries, e.Value.(*memoryEntry))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	messages := make([]MessageStatus, len(entries))
+	for i, entry := range entries {
+		messages[i] = *copyMessageStatus(entry.message)
+	}
+	return messages, nil
+}
+
+// Len returns the number of stored messages.
+func (s *MemoryStatusStorage) Len() int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.order.Len()
+}
+
+// Evict removes the messages exceeding the limits. It is called by Put, so it is needed only to evict
+// old messages when no messages are added.
+func (s *MemoryStatusStorage) Evict() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.evict()
+}
+
+func (s *MemoryStatusStorage) evict() {
+	for s.opts.MaxMessages > 0 && s.order.Len() > s.opts.MaxMessages {
+		s.remove(s.order.Front())
+	}
+	if s.opts.MaxAge > 0 {
+		// The order is sorted by CreatedAt, so the oldest messages are in the front.
+		minCreatedAt := time.Now().Add(-s.opts.MaxAge)
+		for e := s.order.Front(); e != nil && memoryCreatedAt(e).Before(minCreatedAt); e = s.order.Front() {
+			s.remove(e)
+		}
+	}
+}
+
+// place moves the element to keep the order sorted by CreatedAt. Messages are usually put soon after creation,
+// so the element is moved by a few positions at most.
+func (s *MemoryStatusStorage) place(e *list.Element) {
+	createdAt := memoryCreatedAt(e)
+	if next := e.Next(); next != nil && memoryCreatedAt(next).Before(createdAt) {
+		for next.Next() != nil && memoryCreatedAt(next.Next()).Before(createdAt) {
+			next = next.Next()
+		}
+		s.order.MoveAfter(e, next)
+		return
+	}
+	prev := e.Prev()
+	for prev != nil && createdAt.Before(memoryCreatedAt(prev)) {
+		prev = prev.Prev()
+	}
+	if prev == nil {
+		s.order.MoveToFront(e)
+	} else {
+		s.order.MoveAfter(e, prev)
+	}
+}
+
+func memoryCreatedAt(e *list.Element) time.Time {
+	return e.Value.(*memoryEntry).message.CreatedAt
+}
+
+func (s *MemoryStatusStorage) remove(e *list.Element) {
+	message := e.Value.(*memoryEntry).message
+	s.order.Remove(e)
+	delete(s.pending, e)
+	recipients := s.byId[message.MessageId]
+	delete(recipients, memoryKey{message.Phone, message.Gateway})
+	if len(recipients) == 0 {
+		delete(s.byId, message.MessageId)
+	}
+}
+
+// SaveSnapshot writes all messages to the file in JSON. The file is replaced atomically, so a failed save
+// doesn't corrupt the previous snapshot.
+func (s *MemoryStatusStorage) SaveSnapshot(path string) error {
+	s.m.RLock()
+	messages := make([]*MessageStatus, 0, s.order.Len())
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		messages = append(messages, e.Value.(*memoryEntry).message)
+	}
+	data, err := json.Marshal(messages)
+	s.m.RUnlock()
+	if err != nil {
+		return logger.Error(err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return logger.Error(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return logger.Error(err)
+	}
+	// The data must reach the disk before the rename, otherwise a crash may leave an empty snapshot.
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return logger.Error(err)
+	}
+	if err = tmp.Close(); err != nil {
+		return logger.Error(err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return logger.Error(err)
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces the stored messages by the ones saved to the file by SaveSnapshot. Messages
+// exceeding the limits are evicted.
+func (s *MemoryStatusStorage) RestoreSnapshot(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return logger.Error(err)
+	}
+	var messages []*MessageStatus
+	if err = json.Unmarshal(data, &messages); err != nil {
+		return logger.Error(err)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.reset()
+	for _, message := range messages {
+		if message != nil {
+			s.put(message)
+		}
+	}
+	s.evict()
+	return nil
+}
+
+func copyMessageStatus(message *MessageStatus) *MessageStatus {
+	c := *message
+	if message.Options != nil {
+		opts := *message.Options
+		c.Options = &opts
+	}
+	return &c
+}
@@ -0,0 +1,174 @@
+package gosmsc
+
+import (
+	"encoding/json"
+	. "github.com/goodsign/gosmsc/contract"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestMemoryStorage(t *testing.T) *MemoryStatusStorage {
+	storage, err := NewMemoryStatusStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestMemoryStoragePending(t *testing.T) {
+	storage := newTestMemoryStorage(t)
+
+	for i := int64(1); i <= 3; i++ {
+		if err := storage.Put(NewUnknownMessageStatus(i, "79000000001")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.Put(NewUnknownMessageStatus(1, "79000000002"))
+
+	delivered := NewUnknownMessageStatus(2, "79000000001")
+	delivered.StatusCode = MessageStatusComplete
+	storage.Put(delivered)
+
+	pending, err := storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("Expected %d pending messages. Got '%d'", 3, len(pending))
+	}
+	if pending[0].MessageId != 1 || pending[1].MessageId != 3 || pending[2].Phone != "79000000002" {
+		t.Fatalf("Pending messages are not in the order of adding. Got '%v'", pending)
+	}
+
+	message, err := storage.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Phone != "79000000001" {
+		t.Fatalf("Expected the first recipient '%s'. Got '%s'", "79000000001", message.Phone)
+	}
+	if _, err = storage.GetRecipient(2, "79000000002", ""); err != MessageNotFound {
+		t.Fatalf("Expected MessageNotFound. Got '%v'", err)
+	}
+
+	// Returned messages are copies.
+	message.StatusCode = MessageStatusComplete
+	if message, _ = storage.Get(1); message.StatusCode != MessageStatusCodeUnknown {
+		t.Fatalf("Storage message changed by the caller. Got '%v'", message.StatusCode)
+	}
+}
+
+func TestMemoryStorageEviction(t *testing.T) {
+	storage, err := NewMemoryStatusStorage(&MemoryStorageOptions{MaxMessages: 2, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := NewUnknownMessageStatus(1, "79000000001")
+	old.CreatedAt = time.Now().Add(-2 * time.Hour)
+	storage.Put(old)
+	if storage.Len() != 0 {
+		t.Fatalf("Expected old message to be evicted. Got '%d' messages", storage.Len())
+	}
+
+	for i := int64(2); i <= 4; i++ {
+		storage.Put(NewUnknownMessageStatus(i, "79000000001"))
+	}
+	if storage.Len() != 2 {
+		t.Fatalf("Expected %d messages. Got '%d'", 2, storage.Len())
+	}
+	if _, err = storage.Get(2); err != MessageNotFound {
+		t.Fatalf("Expected the oldest message to be evicted. Got '%v'", err)
+	}
+	pending, _ := storage.GetPending()
+	if len(pending) != 2 {
+		t.Fatalf("Expected %d pending messages. Got '%d'", 2, len(pending))
+	}
+
+	if _, err = NewMemoryStatusStorage(&MemoryStorageOptions{MaxMessages: -1}); err == nil {
+		t.Fatalf("Expected negative MaxMessages to be refused")
+	}
+}
+
+func TestMemoryStorageEvictionOutOfOrder(t *testing.T) {
+	storage, err := NewMemoryStatusStorage(&MemoryStorageOptions{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Put(NewUnknownMessageStatus(1, "79000000001"))
+	old := NewUnknownMessageStatus(2, "79000000001")
+	old.CreatedAt = time.Now().Add(-2 * time.Hour)
+	storage.Put(old)
+	if _, err = storage.Get(2); err != MessageNotFound {
+		t.Fatalf("Expected old message added after a new one to be evicted. Got '%v'", err)
+	}
+
+	// Snapshots may list messages out of the creation order too.
+	dir, err := ioutil.TempDir("", "gosmsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "messages.json")
+	data, err := json.Marshal([]*MessageStatus{NewUnknownMessageStatus(1, "79000000001"), old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Len() != 1 {
+		t.Fatalf("Expected old message to be evicted on restore. Got '%d' messages", storage.Len())
+	}
+}
+
+func TestMemoryStorageSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosmsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "messages.json")
+
+	storage := newTestMemoryStorage(t)
+	message := NewUnknownMessageStatus(1, "79000000001")
+	message.Options = &SendOptions{Sender: "sender", Valid: time.Hour}
+	storage.Put(message)
+	delivered := NewUnknownMessageStatus(2, "79000000001")
+	delivered.StatusCode = MessageStatusComplete
+	storage.Put(delivered)
+
+	if err = storage.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestMemoryStorage(t)
+	restored.Put(NewUnknownMessageStatus(3, "79000000001"))
+	if err = restored.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != 2 {
+		t.Fatalf("Expected %d restored messages. Got '%d'", 2, restored.Len())
+	}
+	got, err := restored.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Options == nil || got.Options.Sender != "sender" || !got.CreatedAt.Equal(message.CreatedAt) {
+		t.Fatalf("Restored message differs. Expected '%v'. Got '%v'", message, got)
+	}
+	pending, _ := restored.GetPending()
+	if len(pending) != 1 || pending[0].MessageId != 1 {
+		t.Fatalf("Expected message %d to be pending. Got '%v'", 1, pending)
+	}
+
+	if err = restored.RestoreSnapshot(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatalf("Expected missing snapshot error")
+	}
+}
@@ -0,0 +1,98 @@
+package gosmsc
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	mgohelper "github.com/goodsign/goutils/mgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	incomingCollection      = "incoming"
+	IncomingMessageNotFound = errors.New("Incoming message not found")
+)
+
+// IncomingMgoStorage is a default mgo implementation of the IncomingContainer.
+type IncomingMgoStorage struct {
+	h *mgohelper.DbHelper
+}
+
+func NewIncomingMgoStorage(dbHelper *mgohelper.DbHelper) (*IncomingMgoStorage, error) {
+	if dbHelper == nil {
+		return nil, fmt.Errorf("dbHelper is nil")
+	}
+	return &IncomingMgoStorage{dbHelper}, nil
+}
+
+func (is *IncomingMgoStorage) PutIncoming(message *IncomingMessage) error {
+	if message == nil {
+		return logger.Errorf("message is nil")
+	}
+	logger.Tracef("incoming message id: '%d'", message.Id)
+
+	c, s := is.h.C(incomingCollection)
+	defer s.Close()
+	// The same message can come both from the callback and from polling, the first one wins.
+	_, err := c.Upsert(bson.M{"id": message.Id}, bson.M{"$setOnInsert": message})
+	return err
+}
+
+func (is *IncomingMgoStorage) GetIncoming(id int64) (*IncomingMessage, error) {
+	logger.Tracef("id: '%d'", id)
+	c, s := is.h.C(incomingCollection)
+	defer s.Close()
+
+	message := new(IncomingMessage)
+	err := c.Find(bson.M{"id": id}).One(message)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			return nil, logger.Error(err)
+		}
+		return nil, IncomingMessageNotFound
+	}
+	return message, nil
+}
+
+func (is *IncomingMgoStorage) ListIncoming(unacknowledgedOnly bool, limit int) ([]IncomingMessage, error) {
+	logger.Trace("")
+	c, s := is.h.C(incomingCollection)
+	defer s.Close()
+
+	query := bson.M{}
+	if unacknowledgedOnly {
+		query["acknowledged"] = false
+	}
+	var messages []IncomingMessage
+	err := c.Find(query).Sort("receivedat", "id").Limit(limit).All(&messages)
+	if err != nil {
+		return nil, logger.Error(err)
+	}
+	return messages, nil
+}
+
+func (is *IncomingMgoStorage) AcknowledgeIncoming(ids []int64) error {
+	logger.Tracef("ids: '%v'", ids)
+	c, s := is.h.C(incomingCollection)
+	defer s.Close()
+
+	_, err := c.UpdateAll(bson.M{"id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"acknowledged": true}})
+	return err
+}
+
+func (is *IncomingMgoStorage) LastIncomingId() (int64, error) {
+	logger.Trace("")
+	c, s := is.h.C(incomingCollection)
+	defer s.Close()
+
+	message := new(IncomingMessage)
+	err := c.Find(nil).Sort("-id").One(message)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			return 0, logger.Error(err)
+		}
+		return 0, nil
+	}
+	return message.Id, nil
+}
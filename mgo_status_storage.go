@@ -44,6 +44,24 @@ func (ms *MessageStatusMgoStorage) Get(messageId int64) (*MessageStatus, error)
 	return message, nil
 }
 
+// GetRecipient returns the status of a message sent to several recipients or through several gateways for one of them.
+func (ms *MessageStatusMgoStorage) GetRecipient(messageId int64, phone string, gateway string) (*MessageStatus, error) {
+	logger.Tracef("messageId: '%d', phone: '%s', gateway: '%s'", messageId, phone, gateway)
+	c, s := ms.h.C(messagesCollection)
+	defer s.Close()
+
+	message := new(MessageStatus)
+	err := c.Find(bson.M{"messageid": messageId, "phone": phone, "gateway": gatewaySelector(gateway)}).One(message)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			return nil, logger.Error(err)
+		}
+		return nil, MessageNotFound
+	}
+
+	return message, nil
+}
+
 func (ms *MessageStatusMgoStorage) Put(message *MessageStatus) error {
 	if message == nil {
 		return logger.Errorf("message is nil")
@@ -52,10 +70,20 @@ func (ms *MessageStatusMgoStorage) Put(message *MessageStatus) error {
 
 	c, s := ms.h.C(messagesCollection)
 	defer s.Close()
-	_, err := c.Upsert(bson.M{"messageid": message.MessageId, "phone": message.Phone}, message)
+	_, err := c.Upsert(bson.M{"messageid": message.MessageId, "phone": message.Phone, "gateway": gatewaySelector(message.Gateway)}, message)
 	return err
 }
 
+// gatewaySelector matches the gateway of the message. Messages stored before the gateway was recorded
+// don't have the field, they are matched as sent without a composite provider.
+func gatewaySelector(gateway string) interface{} {
+	if len(gateway) == 0 {
+		return bson.M{"$in": []interface{}{"", nil}}
+	}
+	return gateway
+}
+
+// GetPending returns messages for which MessageStatus.IsPending is true. The query must be kept in sync with it.
 func (ms *MessageStatusMgoStorage) GetPending() ([]MessageStatus, error) {
 	logger.Trace("")
 
@@ -63,7 +91,7 @@ func (ms *MessageStatusMgoStorage) GetPending() ([]MessageStatus, error) {
 	defer s.Close()
 
 	var messages []MessageStatus
-	err := c.Find(bson.M{"statuscode": bson.M{"$ne": MessageStatusComplete}, "statuserrorcode": 0}).All(&messages)
+	err := c.Find(bson.M{"statuscode": bson.M{"$nin": FinalMessageStatusCodes()}, "statuserrorcode": 0}).All(&messages)
 	if err != nil {
 		return nil, logger.Error(err)
 	}
@@ -0,0 +1,51 @@
+package gosmsc_test
+
+import (
+	"fmt"
+	"github.com/goodsign/gosmsc"
+	"github.com/goodsign/gosmsc/contract"
+	"github.com/goodsign/gosmsc/storagetest"
+	mgohelper "github.com/goodsign/goutils/mgo"
+	"labix.org/v2/mgo"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The mgo storage test needs a MongoDB server, e.g. GOSMSC_MONGO_URL=mongodb://localhost:27017. Every test
+// uses a new database, which is dropped afterwards.
+const mongoUrlEnv = "GOSMSC_MONGO_URL"
+
+func TestMgoStorageConformance(t *testing.T) {
+	url := os.Getenv(mongoUrlEnv)
+	if len(url) == 0 {
+		t.Skipf("%s is not set", mongoUrlEnv)
+	}
+	// Credentials and the database in the url are not supported.
+	hosts := strings.SplitN(strings.TrimPrefix(url, "mongodb://"), "/", 2)[0]
+
+	storagetest.Run(t, func(t *testing.T) contract.StatusContainer {
+		info := &mgo.DialInfo{
+			Addrs:    strings.Split(hosts, ","),
+			Timeout:  10 * time.Second,
+			Database: fmt.Sprintf("gosmsc_test_%d", time.Now().UnixNano()),
+		}
+		hlp, err := mgohelper.Dial(info, &mgohelper.DbHelperInitOptions{&mgo.Safe{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_, s := hlp.C("messages")
+			defer s.Close()
+			if err := s.DB(info.Database).DropDatabase(); err != nil {
+				t.Error(err)
+			}
+		})
+		storage, err := gosmsc.NewMessageStatusMgoStorage(hlp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}, &storagetest.Options{TimePrecision: time.Millisecond})
+}
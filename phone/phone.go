@@ -0,0 +1,179 @@
+// Package phone normalizes phone numbers to the E.164 format and validates them before sending.
+//
+// Numbers of Russia and other CIS countries are checked by their national number lengths and
+// ranges, other numbers only by their country calling code and the E.164 length limits.
+package phone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	MaxE164Digits = 15 // Max number of digits in an E.164 number including the country code
+	MinE164Digits = 8  // Min number of digits accepted for countries without specific rules
+)
+
+var (
+	ErrInvalidPhone = errors.New("Invalid phone number")
+)
+
+// Country describes the numbering rules of a country.
+type Country struct {
+	Name           string
+	CallingCode    string
+	NationalLength int    // Number of digits after the calling code
+	FirstDigits    string // Allowed first digits of the national number. Empty means any
+}
+
+// Countries with specific rules. Russia and Kazakhstan share the '7' code, so they are told apart
+// by the first digit of the national number.
+var Countries = []Country{
+	{"Russia", "7", 10, "34589"},
+	{"Kazakhstan", "7", 10, "67"},
+	{"Ukraine", "380", 9, ""},
+	{"Belarus", "375", 9, ""},
+	{"Moldova", "373", 8, ""},
+	{"Armenia", "374", 8, ""},
+	{"Azerbaijan", "994", 9, ""},
+	{"Georgia", "995", 9, ""},
+	{"Kyrgyzstan", "996", 9, ""},
+	{"Tajikistan", "992", 9, ""},
+	{"Turkmenistan", "993", 8, ""},
+	{"Uzbekistan", "998", 9, ""},
+}
+
+// Country calling codes consisting of one or two digits. Other assigned codes have three digits.
+var shortCallingCodes = map[string]bool{
+	"1": true, "7": true,
+	"20": true, "27": true, "30": true, "31": true, "32": true, "33": true, "34": true, "36": true, "39": true,
+	"40": true, "41": true, "43": true, "44": true, "45": true, "46": true, "47": true, "48": true, "49": true,
+	"51": true, "52": true, "53": true, "54": true, "55": true, "56": true, "57": true, "58": true,
+	"60": true, "61": true, "62": true, "63": true, "64": true, "65": true, "66": true,
+	"81": true, "82": true, "84": true, "86": true,
+	"90": true, "91": true, "92": true, "93": true, "94": true, "95": true, "98": true,
+}
+
+// Prefixes of the unassigned or non-geographic three-digit codes.
+var reservedCallingCodePrefixes = []string{"0", "28", "80", "83", "89"}
+
+// Normalize converts the phone number to the E.164 format, e.g. '+7 (921) 123-45-67' to '+79211234567'.
+//
+// Spaces, dashes, dots and parentheses are ignored. The number must be in the international format
+// with or without '+', or start with the '00' international prefix. Russian national numbers
+// starting with '8' are converted to '+7'. Returns an error wrapping ErrInvalidPhone if the number
+// is invalid.
+func Normalize(phone string) (string, error) {
+	digits, plus, err := digitsOf(phone)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case !plus && strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case !plus && len(digits) == 11 && digits[0] == '8':
+		digits = "7" + digits[1:]
+	}
+
+	if err = validate(digits); err != nil {
+		return "", fmt.Errorf("%w '%s': %s", ErrInvalidPhone, phone, err)
+	}
+	return "+" + digits, nil
+}
+
+// IsValid returns true if the phone number can be normalized.
+func IsValid(phone string) bool {
+	_, err := Normalize(phone)
+	return err == nil
+}
+
+// CountryOf returns the country of a normalized number. Returns false if the country has no specific
+// rules or the number is not normalized.
+func CountryOf(e164 string) (Country, bool) {
+	if !strings.HasPrefix(e164, "+") {
+		return Country{}, false
+	}
+	digits := e164[1:]
+	for _, c := range Countries {
+		national := strings.TrimPrefix(digits, c.CallingCode)
+		if len(national) == len(digits) {
+			continue
+		}
+		if len(c.FirstDigits) == 0 || (len(national) != 0 && strings.IndexByte(c.FirstDigits, national[0]) >= 0) {
+			return c, true
+		}
+	}
+	return Country{}, false
+}
+
+// digitsOf extracts the digits of the phone number and returns whether it starts with '+'.
+func digitsOf(phone string) (digits string, plus bool, err error) {
+	trimmed := strings.TrimSpace(phone)
+	if strings.HasPrefix(trimmed, "+") {
+		plus = true
+		trimmed = trimmed[1:]
+	}
+	var b strings.Builder
+	for _, r := range trimmed {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", false, fmt.Errorf("%w '%s': unexpected character '%c'", ErrInvalidPhone, phone, r)
+		}
+	}
+	if b.Len() == 0 {
+		return "", false, fmt.Errorf("%w '%s': no digits", ErrInvalidPhone, phone)
+	}
+	return b.String(), plus, nil
+}
+
+// validate checks the international number digits without '+'.
+func validate(digits string) error {
+	if len(digits) > MaxE164Digits {
+		return fmt.Errorf("more than %d digits", MaxE164Digits)
+	}
+	code := callingCode(digits)
+	if len(code) == 0 {
+		return fmt.Errorf("unknown country code")
+	}
+
+	national := digits[len(code):]
+	matched := false
+	for _, c := range Countries {
+		if c.CallingCode != code {
+			continue
+		}
+		matched = true
+		if len(national) == c.NationalLength && (len(c.FirstDigits) == 0 || strings.IndexByte(c.FirstDigits, national[0]) >= 0) {
+			return nil
+		}
+	}
+	if matched {
+		return fmt.Errorf("invalid number for country code %s", code)
+	}
+	if len(digits) < MinE164Digits {
+		return fmt.Errorf("less than %d digits", MinE164Digits)
+	}
+	return nil
+}
+
+// callingCode returns the country calling code the digits start with, or an empty string if it is not assigned.
+func callingCode(digits string) string {
+	for _, prefix := range reservedCallingCodePrefixes {
+		if strings.HasPrefix(digits, prefix) {
+			return ""
+		}
+	}
+	for l := 1; l <= 2 && l < len(digits); l++ {
+		if shortCallingCodes[digits[:l]] {
+			return digits[:l]
+		}
+	}
+	if len(digits) <= 3 {
+		return ""
+	}
+	return digits[:3]
+}
@@ -0,0 +1,89 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	valid := map[string]string{
+		"+7 921 123 45 67":   "+79211234567",
+		"+7 (921) 123-45-67": "+79211234567",
+		"79211234567":        "+79211234567",
+		"89211234567":        "+79211234567",
+		"8 (495) 123-45-67":  "+74951234567",
+		"0079211234567":      "+79211234567",
+		"+7 701 123 45 67":   "+77011234567",
+		"+375 29 123 45 67":  "+375291234567",
+		"+380 50 123 4567":   "+380501234567",
+		"+998 90 123 45 67":  "+998901234567",
+		"+1 (212) 555-0100":  "+12125550100",
+		"+44 20 7946 0958":   "+442079460958",
+		" +49 30 123456 ":    "+4930123456",
+		"+995.555.12.34.56":  "+995555123456",
+		"+374 10 123456":     "+37410123456",
+		"+86 138 0013 8000":  "+8613800138000",
+		"+996 555 123 456":   "+996555123456",
+		"+993 12 345678":     "+99312345678",
+		"+992 93 123 4567":   "+992931234567",
+		"+994 50 123 45 67":  "+994501234567",
+		"+373 69 123456":     "+37369123456",
+		"+7 (3412) 12-34-56": "+73412123456",
+		"+7 800 555 35 35":   "+78005553535",
+		"+33 1 23 45 67 89":  "+33123456789",
+		"+81 3-1234-5678":    "+81312345678",
+		"+61 2 1234 5678":    "+61212345678",
+		"+55 11 91234 5678":  "+5511912345678",
+		"+91 98765 43210":    "+919876543210",
+		"+20 10 1234 5678":   "+201012345678",
+		"+90 532 123 45 67":  "+905321234567",
+	}
+	for in, expected := range valid {
+		out, err := Normalize(in)
+		if err != nil {
+			t.Fatalf("Expected '%s' to be valid. Got error: '%s'", in, err)
+		}
+		if out != expected {
+			t.Fatalf("Expected '%s' to be normalized to '%s'. Got '%s'", in, expected, out)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"+",
+		"abc",
+		"+7 921 123 45 6",
+		"+7 921 123 45 678",
+		"+7 021 123 45 67",
+		"+375 29 123 45 6",
+		"+380 50 123 45 678",
+		"8921123456",
+		"+0 123 456 789",
+		"+28 123 456 789",
+		"+1 234",
+		"+44 1234 5678 9012 34",
+		"+7 921 123 45 67 ext. 1",
+	}
+	for _, in := range invalid {
+		if _, err := Normalize(in); !errors.Is(err, ErrInvalidPhone) {
+			t.Fatalf("Expected '%s' to be invalid. Got: '%v'", in, err)
+		}
+	}
+}
+
+func TestCountryOf(t *testing.T) {
+	expected := map[string]string{
+		"+79211234567":  "Russia",
+		"+77011234567":  "Kazakhstan",
+		"+375291234567": "Belarus",
+	}
+	for in, name := range expected {
+		c, ok := CountryOf(in)
+		if !ok || c.Name != name {
+			t.Fatalf("Expected '%s' country = '%s'. Got '%v'", in, name, c)
+		}
+	}
+	if _, ok := CountryOf("+12125550100"); ok {
+		t.Fatal("Expected no specific rules for '+12125550100'")
+	}
+}
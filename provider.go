@@ -0,0 +1,127 @@
+package gosmsc
+
+import (
+	"context"
+	. "github.com/goodsign/gosmsc/contract"
+	"time"
+)
+
+const (
+	SmscProviderName = "smsc"
+)
+
+// SmscProvider is the Provider implementation for the smsc.ru gateway.
+type SmscProvider struct {
+	client *smsClientInternal
+}
+
+func NewSmscProvider(opts *SmscClientOptions) (*SmscProvider, error) {
+	sint, err := newSmsClientInternal(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SmscProvider{sint}, nil
+}
+
+func (p *SmscProvider) Name() string {
+	return SmscProviderName
+}
+
+func (p *SmscProvider) SendMessage(ctx context.Context, phone string, text string, opts *SendOptions) (*SendResult, error) {
+	output, err := p.client.SendWithOptionsContext(ctx, phone, text, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = output.Err(); err != nil {
+		return nil, err
+	}
+	return &SendResult{Id: output.Id}, nil
+}
+
+func (p *SmscProvider) FetchMessageStatus(ctx context.Context, id int64, phone string) (*StatusResult, error) {
+	output, err := p.client.FetchStatusContext(ctx, id, phone)
+	if err != nil {
+		return nil, err
+	}
+	if err = output.Err(); err != nil {
+		return nil, err
+	}
+	result := &StatusResult{
+		Id:              id,
+		Phone:           phone,
+		StatusCode:      MessageStatusCode(output.StatusCode),
+		Operator:        output.Operator,
+		Region:          output.Region,
+		StatusErrorCode: output.StatusErrorCode,
+	}
+	if updatedAt, err := time.Parse(smscDateLayout, output.StatusDate); err == nil {
+		result.StatusUpdatedAt = updatedAt
+	}
+	return result, nil
+}
+
+// providerClient adapts a Provider to the Sender and StatusFetcher interfaces used by SenderCheckerImpl
+// and MessageTracker. Provider errors are returned as errors, results are converted to the smsc.ru responses.
+type providerClient struct {
+	provider Provider
+}
+
+func (c *providerClient) Send(phone string, text string) (*SendSMSResponse, error) {
+	return c.SendWithOptionsContext(context.Background(), phone, text, nil)
+}
+
+func (c *providerClient) SendContext(ctx context.Context, phone string, text string) (*SendSMSResponse, error) {
+	return c.SendWithOptionsContext(ctx, phone, text, nil)
+}
+
+func (c *providerClient) SendWithOptionsContext(ctx context.Context, phone string, text string, opts *SendOptions) (*SendSMSResponse, error) {
+	result, err := c.provider.SendMessage(ctx, phone, text, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SendSMSResponse{Id: result.Id, Gateway: result.Gateway}, nil
+}
+
+func (c *providerClient) FetchStatus(id int64, phone string) (*CheckStatusResponse, error) {
+	return c.FetchStatusContext(context.Background(), id, phone)
+}
+
+func (c *providerClient) FetchStatusContext(ctx context.Context, id int64, phone string) (*CheckStatusResponse, error) {
+	result, err := c.provider.FetchMessageStatus(ctx, id, phone)
+	if err != nil {
+		return nil, err
+	}
+	return statusResponse(result), nil
+}
+
+// FetchGatewayStatusContext fetches the status from the gateway if the provider routes messages across several
+// gateways, or from the provider itself otherwise.
+func (c *providerClient) FetchGatewayStatusContext(ctx context.Context, gateway string, id int64, phone string) (*CheckStatusResponse, error) {
+	p, ok := c.provider.(MultiGatewayProvider)
+	if !ok {
+		return c.FetchStatusContext(ctx, id, phone)
+	}
+	result, err := p.FetchGatewayMessageStatus(ctx, gateway, id, phone)
+	if err != nil {
+		return nil, err
+	}
+	return statusResponse(result), nil
+}
+
+// statusResponse converts the provider-neutral status to the response consumed by the tracker.
+func statusResponse(result *StatusResult) *CheckStatusResponse {
+	updatedAt := result.StatusUpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = time.Now()
+	}
+	return &CheckStatusResponse{
+		StatusCode: int32(result.StatusCode),
+		// The tracker parses the date as UTC.
+		StatusDate:      updatedAt.UTC().Format(smscDateLayout),
+		Operator:        result.Operator,
+		Region:          result.Region,
+		StatusErrorCode: result.StatusErrorCode,
+		Id:              result.Id,
+		Phone:           result.Phone,
+	}
+}
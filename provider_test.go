@@ -0,0 +1,142 @@
+package gosmsc
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/goodsign/gosmsc/contract"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHttpProvider is a local gateway implementing the HttpProvider protocol. Sent messages get
+// the configured status.
+type fakeHttpProvider struct {
+	*httptest.Server
+	m      sync.Mutex
+	sent   []httpProviderSendRequest
+	status string
+}
+
+func newFakeHttpProvider(status string) *fakeHttpProvider {
+	f := &fakeHttpProvider{status: status}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid token","code":401}`))
+			return
+		}
+		var req httpProviderSendRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.m.Lock()
+		f.sent = append(f.sent, req)
+		id := len(f.sent)
+		f.m.Unlock()
+		json.NewEncoder(w).Encode(map[string]int{"id": id})
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		f.m.Lock()
+		status := f.status
+		f.m.Unlock()
+		w.Write([]byte(`{"status":"` + status + `","updated_at":"2014-03-05T10:20:30Z","operator":"MTS"}`))
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func TestHttpProvider(t *testing.T) {
+	f := newFakeHttpProvider("delivered")
+	defer f.Close()
+
+	provider, err := NewHttpProvider(&HttpProviderOptions{SendUrl: f.URL + "/send", StatusUrl: f.URL + "/status", Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := newMessageStatusTestStorage()
+	impl, err := NewSenderCheckerImplWithProvider(provider, storage, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	id, err := impl.SendWithOptions("+7 921 123 45 67", "test", true, &SendOptions{Sender: "Shop", Valid: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.m.Lock()
+	sent := f.sent[0]
+	f.m.Unlock()
+	if sent.Phone != "+79211234567" || sent.Sender != "Shop" || sent.Ttl != 3600 {
+		t.Fatalf("Unexpected request: '%v'", sent)
+	}
+
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusComplete || mstatus.Operator != "MTS" {
+		t.Fatalf("Unexpected status: '%v'", mstatus)
+	}
+	if !mstatus.StatusUpdatedAt.Equal(time.Date(2014, 3, 5, 10, 20, 30, 0, time.UTC)) {
+		t.Fatalf("Unexpected status time: '%v'", mstatus.StatusUpdatedAt)
+	}
+
+	provider, err = NewHttpProvider(&HttpProviderOptions{SendUrl: f.URL + "/send", StatusUrl: f.URL + "/status", Token: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl2, err := NewSenderCheckerImplWithProvider(provider, storage, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl2.tracker.Stop()
+	_, err = impl2.Send("+7 921 123 45 67", "test", false)
+	if perr, ok := err.(*HttpProviderError); !ok || perr.HttpStatus != http.StatusUnauthorized || perr.Message != "invalid token" {
+		t.Fatalf("Expected to get provider error. Got: '%v'.", err)
+	}
+}
+
+func TestSmscProvider(t *testing.T) {
+	g := newFakeGateway(`{"id":42,"cnt":1}`)
+	defer g.Close()
+
+	provider, err := NewSmscProvider(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl, err := NewSenderCheckerImplWithProvider(provider, newMessageStatusTestStorage(), time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	id, err := impl.Send("+7 921 123 45 67", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 42 {
+		t.Fatalf("Expected id = '42'. Got '%d'", id)
+	}
+
+	g.setResponse(`{"status":1,"last_date":"05.03.2014 10:20:30"}`)
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusComplete {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusComplete, mstatus.StatusCode)
+	}
+
+	g.setResponse(`{"error":"invalid login","error_code":2}`)
+	if _, err = impl.Send("+7 921 123 45 67", "test", false); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected to get gateway error. Got: '%v'.", err)
+	}
+}
@@ -0,0 +1,63 @@
+package gosmsc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of gateway requests. The bucket holds up to 'burst' tokens and is
+// refilled with 'rate' tokens per second. Each request takes one token and waits if there are none.
+type tokenBucket struct {
+	m      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns the time to wait before it can be used. Tokens may go
+// negative, so concurrent callers are queued one after another.
+func (b *tokenBucket) reserve() time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a token taken by reserve, which wasn't used.
+func (b *tokenBucket) cancel() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.tokens++
+}
+
+// Wait blocks until a request is allowed or the context is done.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	d := b.reserve()
+	if d == 0 {
+		return nil
+	}
+	err := sleepContext(ctx, d)
+	if err != nil {
+		b.cancel()
+	}
+	return err
+}
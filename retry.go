@@ -0,0 +1,131 @@
+package gosmsc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultBackoffFactor  = 2.0
+)
+
+// RetryPolicy defines how failed gateway calls are retried. Delay before the n-th retry is
+// InitialBackoff * Multiplier^(n-1), limited by MaxBackoff and randomized by Jitter.
+type RetryPolicy struct {
+	MaxAttempts    int                  // Total number of attempts including the first one. Values < 2 disable retries.
+	InitialBackoff time.Duration        // Delay before the first retry. Defaults to DefaultInitialBackoff.
+	MaxBackoff     time.Duration        // Upper limit of the delay. Defaults to DefaultMaxBackoff.
+	Multiplier     float64              // Delay growth factor. Defaults to DefaultBackoffFactor.
+	Jitter         float64              // Fraction of the delay [0, 1] that is randomly added or subtracted.
+	Retryable      func(err error) bool // Decides whether an error is retried. Defaults to IsRetryableError.
+	Resendable     func(err error) bool // Decides whether an error of a message sending call is retried. Defaults to IsResendableError.
+}
+
+// Backoff returns the delay before the retry with the specified number (starting from 1).
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	initial, max, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = DefaultInitialBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	if multiplier < 1 {
+		multiplier = DefaultBackoffFactor
+	}
+
+	d := math.Min(float64(initial)*math.Pow(multiplier, float64(retry-1)), float64(max))
+	if p.Jitter > 0 {
+		d += d * math.Min(p.Jitter, 1) * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) isRetryable(err error, send bool) bool {
+	if send {
+		if p.Resendable != nil {
+			return p.Resendable(err)
+		}
+		return IsResendableError(err)
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryableError(err)
+}
+
+// IsRetryableError returns true for errors that may disappear if the call is repeated: transport
+// errors, gateway 5xx responses and the ErrTooManyRequests gateway error.
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var smscErr *SmscError
+	if errors.As(err, &smscErr) {
+		return smscErr.Is(ErrTooManyRequests)
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// IsResendableError returns true for errors proving that the gateway didn't send the message, so sending it
+// again doesn't duplicate it: the request wasn't delivered (dial errors and refused connections), the gateway
+// responded with a 5xx status or returned the ErrTooManyRequests error. Other transport errors, e.g. timeouts,
+// are ambiguous, because the gateway may have accepted the request.
+func IsResendableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var smscErr *SmscError
+	if errors.As(err, &smscErr) {
+		return smscErr.Is(ErrTooManyRequests)
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500
+	}
+	return isNotDeliveredError(err)
+}
+
+// isNotDeliveredError returns true if the request surely didn't reach the server.
+func isNotDeliveredError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// httpStatusError is returned when the gateway responds with a non-200 http status.
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("Gateway responded with http status %d", e.code)
+}
+
+// sleepContext waits for the specified duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
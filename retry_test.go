@@ -0,0 +1,183 @@
+package gosmsc
+
+import (
+	"context"
+	"errors"
+	. "github.com/goodsign/gosmsc/contract"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSequenceGateway creates a fake gateway returning the responses one by one. The last
+// response is repeated. Response "500" is returned as the internal server error http status.
+func newSequenceGateway(responses ...string) (*httptest.Server, *int) {
+	var m sync.Mutex
+	calls := new(int)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		i := *calls
+		*calls++
+		m.Unlock()
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+		if responses[i] == "500" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(responses[i]))
+	})), calls
+}
+
+func TestRetryOnTooManyRequests(t *testing.T) {
+	g, calls := newSequenceGateway(`{"error":"too many requests","error_code":9}`, "500", `{"id":7,"cnt":1}`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL,
+		Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := c.Send("79211234567", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Id != 7 || *calls != 3 {
+		t.Fatalf("Expected id = '7' after 3 calls. Got '%d' after '%d'", output.Id, *calls)
+	}
+}
+
+func TestNoRetryOnPermanentError(t *testing.T) {
+	g, calls := newSequenceGateway(`{"error":"no money","error_code":3}`)
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL,
+		Retry: &RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := c.Send("79211234567", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(output.Err(), ErrInsufficientFunds) || *calls != 1 {
+		t.Fatalf("Expected '%s' after 1 call. Got '%v' after '%d'", ErrInsufficientFunds, output.Err(), *calls)
+	}
+}
+
+func TestRetryAttemptsExhausted(t *testing.T) {
+	g, calls := newSequenceGateway("500")
+	defer g.Close()
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL,
+		Retry: &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.FetchStatus(1, "79211234567"); err == nil {
+		t.Fatal("Expected to get error. Got: nil.")
+	}
+	if *calls != 2 {
+		t.Fatalf("Expected 2 calls. Got '%d'", *calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 3}
+	expected := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second}
+	for i, e := range expected {
+		if d := p.Backoff(i + 1); d != e {
+			t.Fatalf("Expected backoff %d = '%v'. Got '%v'", i+1, e, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Backoff(1); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("Backoff '%v' is out of jitter range", d)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(50, 2)
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 requests are allowed by burst, 5 more need 100ms at 50 rps.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("Expected requests to be limited. Took '%v'", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b = newTokenBucket(1, 1)
+	b.Wait(ctx)
+	if err := b.Wait(ctx); err != context.Canceled {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", context.Canceled, err)
+	}
+}
+
+func TestNoResendAfterTimeout(t *testing.T) {
+	var m sync.Mutex
+	calls := 0
+	release := make(chan bool)
+	// The gateway accepts the request and doesn't respond until the client times out.
+	g := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		calls++
+		m.Unlock()
+		<-release
+	}))
+	defer g.Close()
+	defer close(release)
+
+	c, err := newSmsClientInternal(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL, Timeout: 50 * time.Millisecond,
+		Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Send("79211234567", "test"); err == nil {
+		t.Fatal("Expected to get error. Got: nil.")
+	}
+	m.Lock()
+	defer m.Unlock()
+	if calls != 1 {
+		t.Fatalf("Expected 1 send request. Got '%d'", calls)
+	}
+}
+
+func TestResendableError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, err = http.Post("http://"+addr, "text/plain", nil)
+	if err == nil {
+		t.Fatal("Expected to get error. Got: nil.")
+	}
+	if !IsResendableError(err) {
+		t.Fatalf("Expected refused connection to be resendable. Got '%v'", err)
+	}
+	if IsResendableError(&timeoutError{}) {
+		t.Fatal("Expected timeout not to be resendable")
+	}
+	if !IsResendableError(&httpStatusError{http.StatusBadGateway}) {
+		t.Fatal("Expected 5xx status to be resendable")
+	}
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
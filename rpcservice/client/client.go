@@ -1,8 +1,11 @@
 package client
 
 import (
+	"context"
+	"errors"
 	. "github.com/goodsign/gosmsc/contract"
 	service "github.com/goodsign/gosmsc/rpcservice"
+	"github.com/goodsign/gosmsc/segment"
 	"github.com/goodsign/goutils/jsonrpc"
 	"time"
 )
@@ -37,32 +40,204 @@ func NewSmscRpcServiceClient(address string, retryCount int, retryTimeout time.D
 	return db, nil
 }
 
+// getResultContext calls the server method and waits for the result until the context is done.
+// jsonrpc.ServiceClient cannot abort the call itself, so a cancelled call still finishes in
+// background, but its result is discarded.
+func (client *SmscRpcServiceClient) getResultContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.GetResult(method, args, reply)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 //------------------------------------------------
 // ▢ Send
 //------------------------------------------------
 
 func (client *SmscRpcServiceClient) Send(phone string, text string, track bool) (int64, error) {
-	args := service.Send_Args{phone, text, track}
+	return client.SendContext(context.Background(), phone, text, track)
+}
+
+func (client *SmscRpcServiceClient) SendContext(ctx context.Context, phone string, text string, track bool) (int64, error) {
+	return client.send(ctx, &service.Send_Args{phone, text, track, "", nil, true})
+}
+
+// SendWithOptions sends a message with optional send parameters. See SenderCheckerWithOptions.
+func (client *SmscRpcServiceClient) SendWithOptions(phone string, text string, track bool, opts *SendOptions) (int64, error) {
+	return client.SendWithOptionsContext(context.Background(), phone, text, track, opts)
+}
+
+func (client *SmscRpcServiceClient) SendWithOptionsContext(ctx context.Context, phone string, text string, track bool, opts *SendOptions) (int64, error) {
+	return client.send(ctx, &service.Send_Args{phone, text, track, "", opts, true})
+}
+
+// SendWithCallback sends a tracked message. Status change notifications of the message are posted to the callback url.
+func (client *SmscRpcServiceClient) SendWithCallback(phone string, text string, callbackUrl string) (int64, error) {
+	return client.SendWithCallbackContext(context.Background(), phone, text, callbackUrl)
+}
+
+func (client *SmscRpcServiceClient) SendWithCallbackContext(ctx context.Context, phone string, text string, callbackUrl string) (int64, error) {
+	return client.send(ctx, &service.Send_Args{phone, text, true, callbackUrl, nil, true})
+}
+
+func (client *SmscRpcServiceClient) send(ctx context.Context, args *service.Send_Args) (int64, error) {
 	var r service.Send_Reply
 
-	e := client.GetResult(SmscRpcServiceName+"Send", &args, &r)
+	e := client.getResultContext(ctx, SmscRpcServiceName+"Send", args, &r)
 	if e != nil {
 		return 0, e
 	}
+	if r.Error != nil {
+		return 0, r.Error
+	}
 	return r.Id, nil
 }
 
+//------------------------------------------------
+// ▢ SendBulk
+//------------------------------------------------
+
+// SendBulk sends messages to many recipients. Returns results in the order of messages. Nil opts mean no send options.
+func (client *SmscRpcServiceClient) SendBulk(messages []BulkMessage, track bool, opts *SendOptions) ([]BulkSendResult, error) {
+	return client.SendBulkContext(context.Background(), messages, track, opts)
+}
+
+func (client *SmscRpcServiceClient) SendBulkContext(ctx context.Context, messages []BulkMessage, track bool, opts *SendOptions) ([]BulkSendResult, error) {
+	args := service.SendBulk_Args{Messages: messages, Track: track, Options: opts}
+	var r service.SendBulk_Reply
+
+	e := client.getResultContext(ctx, SmscRpcServiceName+"SendBulk", &args, &r)
+	if e != nil {
+		return nil, e
+	}
+	// Results are returned along with the error, because some messages may be sent already.
+	if r.Error != nil {
+		return r.Results, r.Error
+	}
+	if len(r.Failure) != 0 {
+		return r.Results, errors.New(r.Failure)
+	}
+	return r.Results, nil
+}
+
 //------------------------------------------------
 // ▢ GetActualStatus
 //------------------------------------------------
 
 func (client *SmscRpcServiceClient) GetActualStatus(id int64) (*MessageStatus, error) {
+	return client.GetActualStatusContext(context.Background(), id)
+}
+
+func (client *SmscRpcServiceClient) GetActualStatusContext(ctx context.Context, id int64) (*MessageStatus, error) {
 	args := service.GetActualStatus_Args{id}
 	var r service.GetActualStatus_Reply
 
-	e := client.GetResult(SmscRpcServiceName+"GetActualStatus", &args, &r)
+	e := client.getResultContext(ctx, SmscRpcServiceName+"GetActualStatus", &args, &r)
 	if e != nil {
 		return nil, e
 	}
 	return r.Status, nil
 }
+
+//------------------------------------------------
+// ▢ AnalyzeText
+//------------------------------------------------
+
+// AnalyzeText returns the encoding of the text and its parts. Same as segment.Analyze, but done by the service.
+func (client *SmscRpcServiceClient) AnalyzeText(text string) (*segment.Analysis, error) {
+	return client.AnalyzeTextContext(context.Background(), text)
+}
+
+func (client *SmscRpcServiceClient) AnalyzeTextContext(ctx context.Context, text string) (*segment.Analysis, error) {
+	args := service.AnalyzeText_Args{text}
+	var r service.AnalyzeText_Reply
+
+	e := client.getResultContext(ctx, SmscRpcServiceName+"AnalyzeText", &args, &r)
+	if e != nil {
+		return nil, e
+	}
+	return r.Analysis, nil
+}
+
+//------------------------------------------------
+// ▢ Balance
+//------------------------------------------------
+
+// Balance returns the account balance and its currency.
+func (client *SmscRpcServiceClient) Balance() (float64, string, error) {
+	return client.BalanceContext(context.Background())
+}
+
+func (client *SmscRpcServiceClient) BalanceContext(ctx context.Context) (float64, string, error) {
+	args := service.Balance_Args{}
+	var r service.Balance_Reply
+
+	e := client.getResultContext(ctx, SmscRpcServiceName+"Balance", &args, &r)
+	if e != nil {
+		return 0, "", e
+	}
+	if r.Error != nil {
+		return 0, "", r.Error
+	}
+	return r.Balance, r.Currency, nil
+}
+
+// EstimateCost returns the cost of the message and the number of messages to be sent without sending it.
+func (client *SmscRpcServiceClient) EstimateCost(phone string, text string) (float64, int32, error) {
+	return client.EstimateCostContext(context.Background(), phone, text)
+}
+
+func (client *SmscRpcServiceClient) EstimateCostContext(ctx context.Context, phone string, text string) (float64, int32, error) {
+	args := service.EstimateCost_Args{phone, text}
+	var r service.EstimateCost_Reply
+
+	e := client.getResultContext(ctx, SmscRpcServiceName+"EstimateCost", &args, &r)
+	if e != nil {
+		return 0, 0, e
+	}
+	if r.Error != nil {
+		return 0, 0, r.Error
+	}
+	return r.Cost, r.Count, nil
+}
+
+//------------------------------------------------
+// ▢ Incoming
+//------------------------------------------------
+
+// ListIncoming returns messages received by the SMSC number in the order of receiving. Zero limit means no limit.
+func (client *SmscRpcServiceClient) ListIncoming(unacknowledgedOnly bool, limit int) ([]IncomingMessage, error) {
+	return client.ListIncomingContext(context.Background(), unacknowledgedOnly, limit)
+}
+
+func (client *SmscRpcServiceClient) ListIncomingContext(ctx context.Context, unacknowledgedOnly bool, limit int) ([]IncomingMessage, error) {
+	args := service.ListIncoming_Args{unacknowledgedOnly, limit}
+	var r service.ListIncoming_Reply
+
+	e := client.getResultContext(ctx, SmscRpcServiceName+"ListIncoming", &args, &r)
+	if e != nil {
+		return nil, e
+	}
+	return r.Messages, nil
+}
+
+// AcknowledgeIncoming marks received messages as processed.
+func (client *SmscRpcServiceClient) AcknowledgeIncoming(ids []int64) error {
+	return client.AcknowledgeIncomingContext(context.Background(), ids)
+}
+
+func (client *SmscRpcServiceClient) AcknowledgeIncomingContext(ctx context.Context, ids []int64) error {
+	args := service.AcknowledgeIncoming_Args{ids}
+	var r service.AcknowledgeIncoming_Reply
+
+	return client.getResultContext(ctx, SmscRpcServiceName+"AcknowledgeIncoming", &args, &r)
+}
@@ -1,21 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/goodsign/gosmsc"
+	"github.com/goodsign/gosmsc/contract"
 	"github.com/goodsign/gosmsc/rpcservice"
 	"github.com/goodsign/goutils/mgo"
 	"github.com/goodsign/rpc"
 	gjson "github.com/goodsign/rpc/json"
+	"io"
 	"io/ioutil"
 	lmgo "labix.org/v2/mgo"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -25,18 +29,49 @@ const (
 	ErrorCodeInvalidArgs       = -2
 	ErrorCodeInternalInitError = -3
 	ConnectTimeout             = 5 * time.Minute
+	CompactInterval            = time.Hour
+	ShutdownTimeout            = 30 * time.Second
 
-	SeelogCfg   = "seelog.xml"
-	pidFileName = "sms-service.pid"
+	// Message status storage kinds. See the storage flag.
+	StorageMgo    = "mgo"
+	StorageBolt   = "bolt"
+	StorageMemory = "memory"
+
+	SeelogCfg     = "seelog.xml"
+	DefaultConfig = "smsc.default.json"
+	pidFileName   = "sms-service.pid"
+
+	// Environment variables overriding credentials from the config file.
+	EnvUser     = "SMSC_USER"
+	EnvPassword = "SMSC_PASSWORD"
+	EnvApiKey   = "SMSC_APIKEY"
 )
 
 var (
 	rpcPath        = flag.String("rpcpath", "rpc", "Rpc service path (http.Handle parameter)")
 	port           = flag.String("p", "5678", "Port")
-	cfgPath        = flag.String("cfg", "smsc.default.json", "Path to service configuration file")
+	cfgPath        = flag.String("cfg", DefaultConfig, "Path to service configuration file (the default one may be missing if credentials are set by env)")
+	pwdFile        = flag.String("pwdfile", "", "Path to a file containing SMSC password (overrides config and env)")
 	mongoPath      = flag.String("dbpath", "localhost", "Mongo path")
 	mongoDb        = flag.String("mongodb", "gastody_sms_service", "Mongo DB")
 	updateInterval = flag.String("interval", "60000", "Update interval in milliseconds")
+	requestTimeout = flag.String("timeout", "30000", "Gateway request timeout in milliseconds")
+	retryAttempts  = flag.String("retries", "3", "Max attempts of failed gateway calls")
+	batchSize      = flag.String("batch", "100", "Max number of messages in one status request")
+	workers        = flag.String("workers", "1", "Number of concurrent status polling workers")
+	webhookUrl     = flag.String("webhook", "", "Default url receiving status change notifications (optional)")
+	webhookSecret  = flag.String("webhooksecret", "", "Secret used to sign status change notifications (optional)")
+	maxTrackingAge = flag.String("maxage", "0", "Max message tracking age in minutes (0 means no limit)")
+	callbackPath   = flag.String("callbackpath", "", "Path of the SMSC status callback handler (optional, disabled if empty)")
+	callbackSecret = flag.String("callbacksecret", "", "Secret used to verify SMSC callbacks (required if callback or incoming path is set)")
+	callbackPoll   = flag.String("callbackpoll", "30", "Poll interval in minutes of messages that received status callbacks")
+	minBalance     = flag.String("minbalance", "0", "Refuse sending when the account balance is below this amount (0 disables the check)")
+	maxParts       = flag.String("maxparts", "0", "Refuse sending texts longer than this number of sms (0 means no limit)")
+	incomingPoll   = flag.String("incoming", "0", "Incoming messages poll interval in milliseconds (0 disables polling)")
+	incomingPath   = flag.String("incomingpath", "", "Path of the SMSC incoming messages callback handler (optional, disabled if empty)")
+	storageKind    = flag.String("storage", StorageMgo, "Message status storage: mgo, bolt (embedded file) or memory (lost on restart)")
+	storagePath    = flag.String("storagepath", "sms-service.db", "Path of the bolt storage file")
+	retention      = flag.String("retention", "0", "Time in hours completed messages are kept in the bolt storage (0 means forever)")
 )
 
 func loadLogger() {
@@ -50,20 +85,52 @@ func loadLogger() {
 	log.ReplaceLogger(logger)
 }
 
-func unmarshalConfig(configFileName string) (conf *gosmsc.SenderCheckerImpl, err error) {
-	log.Infof("loading config from %s", configFileName)
+// loadClientOptions reads client options from the config file (if specified, a missing default one is skipped)
+// and then overrides the credentials by the environment variables and the password file.
+func loadClientOptions(configFileName string) (*gosmsc.SmscClientOptions, error) {
+	opts := new(gosmsc.SmscClientOptions)
+
+	if len(configFileName) != 0 {
+		log.Infof("loading config from %s", configFileName)
 
-	bytes, err := ioutil.ReadFile(configFileName)
-	if err != nil {
-		return nil, err
+		bytes, err := ioutil.ReadFile(configFileName)
+		switch {
+		case os.IsNotExist(err) && configFileName == DefaultConfig:
+			// Credentials are expected from the env then.
+			log.Infof("%s not found, skipping", configFileName)
+		case err != nil:
+			return nil, err
+		default:
+			log.Debug("Unmarshalling config")
+			err = json.Unmarshal(bytes, opts)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot unmarshal: '%s'", err)
+			}
+		}
 	}
 
-	opts := new(gosmsc.SmscClientOptions)
-	log.Debug("Unmarshalling config")
-	err = json.Unmarshal(bytes, opts)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot unmarshal: '%s'", err)
+	if v := os.Getenv(EnvUser); len(v) != 0 {
+		opts.User = v
 	}
+	if v := os.Getenv(EnvPassword); len(v) != 0 {
+		opts.Password = v
+	}
+	if v := os.Getenv(EnvApiKey); len(v) != 0 {
+		opts.ApiKey = v
+	}
+	if len(*pwdFile) != 0 {
+		bytes, err := ioutil.ReadFile(*pwdFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Password = strings.TrimSpace(string(bytes))
+	}
+
+	log.Debugf("Client options: %s", opts)
+	return opts, nil
+}
+
+func dialDb() (*mgo.DbHelper, error) {
 	dinfo := &lmgo.DialInfo{
 		[]string{*mongoPath},
 		true,
@@ -75,19 +142,85 @@ func unmarshalConfig(configFileName string) (conf *gosmsc.SenderCheckerImpl, err
 		nil,
 		nil,
 	}
-	hlp, err := mgo.Dial(dinfo, &mgo.DbHelperInitOptions{&lmgo.Safe{}})
+	return mgo.Dial(dinfo, &mgo.DbHelperInitOptions{&lmgo.Safe{}})
+}
+
+// openStatusStorage creates the message status storage selected by the storage flag. hlp is used by the mgo storage only.
+func openStatusStorage(hlp *mgo.DbHelper) (contract.StatusContainer, error) {
+	switch *storageKind {
+	case StorageMgo:
+		return gosmsc.NewMessageStatusMgoStorage(hlp)
+	case StorageBolt:
+		hours, err := strconv.ParseInt(*retention, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		opts := &gosmsc.BoltStorageOptions{Retention: time.Hour * time.Duration(hours), OpenTimeout: ConnectTimeout}
+		if hours > 0 {
+			opts.CompactInterval = CompactInterval
+		}
+		return gosmsc.NewMessageStatusBoltStorage(*storagePath, opts)
+	case StorageMemory:
+		return gosmsc.NewMemoryStatusStorage(nil)
+	}
+	return nil, fmt.Errorf("Unknown storage '%s'", *storageKind)
+}
+
+// loadClientConfig returns the client options with the request timeout and retries set by the flags.
+func loadClientConfig(configFileName string) (*gosmsc.SmscClientOptions, error) {
+	opts, err := loadClientOptions(configFileName)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := strconv.ParseInt(*requestTimeout, 10, 32)
 	if err != nil {
 		return nil, err
 	}
-	str, err := gosmsc.NewMessageStatusMgoStorage(hlp)
+	opts.Timeout = time.Millisecond * time.Duration(timeout)
+	attempts, err := strconv.ParseInt(*retryAttempts, 10, 32)
 	if err != nil {
 		return nil, err
 	}
+	opts.Retry = &gosmsc.RetryPolicy{MaxAttempts: int(attempts), Jitter: 0.2}
+	return opts, nil
+}
+
+func unmarshalConfig(opts *gosmsc.SmscClientOptions, str contract.StatusContainer) (conf *gosmsc.SenderCheckerImpl, err error) {
 	upint, err := strconv.ParseInt(*updateInterval, 10, 32)
 	if err != nil {
 		return nil, err
 	}
-	conf, err = gosmsc.NewSenderCheckerImpl(opts, str, time.Millisecond*time.Duration(upint))
+	maxAge, err := strconv.ParseInt(*maxTrackingAge, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	checkerOpts := new(gosmsc.SenderCheckerOptions)
+	checkerOpts.Tracker.MaxTrackingAge = time.Minute * time.Duration(maxAge)
+	batch, err := strconv.ParseInt(*batchSize, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	checkerOpts.Tracker.BatchSize = int(batch)
+	workerCount, err := strconv.ParseInt(*workers, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	checkerOpts.Tracker.Workers = int(workerCount)
+	checkerOpts.MinBalance, err = strconv.ParseFloat(*minBalance, 64)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := strconv.ParseInt(*maxParts, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	checkerOpts.MaxParts = int(parts)
+	callbackPollInterval, err := strconv.ParseInt(*callbackPoll, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	checkerOpts.Tracker.CallbackPollInterval = time.Minute * time.Duration(callbackPollInterval)
+	conf, err = gosmsc.NewSenderCheckerImplWithOptions(opts, str, time.Millisecond*time.Duration(upint), checkerOpts)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid config: '%s'", err)
 	}
@@ -113,14 +246,56 @@ func main() {
 	if len(*port) == 0 {
 		fail(ErrorCodeInvalidArgs, "Please specify port")
 	}
-	if len(*cfgPath) == 0 {
-		fail(ErrorCodeInvalidArgs, "Please specify config file path")
+	incomingInterval, err := strconv.ParseInt(*incomingPoll, 10, 32)
+	if err != nil {
+		fail(ErrorCodeInvalidArgs, fmt.Sprintf("Invalid incoming poll interval. '%s'", err))
+	}
+	incomingEnabled := incomingInterval > 0 || len(*incomingPath) != 0
+
+	// Mongo is dialed only if it stores anything, so bolt and memory storages run without it unless webhooks
+	// or incoming messages are enabled.
+	var hlp *mgo.DbHelper
+	if *storageKind == StorageMgo || len(*webhookUrl) != 0 || incomingEnabled {
+		hlp, err = dialDb()
+		if err != nil {
+			fail(ErrorCodeInternalInitError, fmt.Sprintf("Db init failed. '%s'", err))
+		}
 	}
 
-	sender, err := unmarshalConfig(*cfgPath)
+	storage, err := openStatusStorage(hlp)
+	if err != nil {
+		fail(ErrorCodeInvalidArgs, fmt.Sprintf("Storage init failed. '%s'", err))
+	}
+	opts, err := loadClientConfig(*cfgPath)
+	if err != nil {
+		fail(ErrorCodeInvalidConfig, err.Error())
+	}
+	sender, err := unmarshalConfig(opts, storage)
 	if err != nil {
 		fail(ErrorCodeInvalidConfig, fmt.Sprintf("Sender init failed. '%s'", err))
 	}
+	maxAge, err := strconv.ParseInt(*maxTrackingAge, 10, 32)
+	if err != nil {
+		fail(ErrorCodeInvalidArgs, fmt.Sprintf("Invalid max tracking age. '%s'", err))
+	}
+	trackingAge := time.Minute * time.Duration(maxAge)
+
+	// Messages may be sent with callback urls at any time, so webhooks are always enabled. Without mongo the
+	// delivery log is kept in memory for the max tracking age.
+	var webhookStorage rpcservice.WebhookStorage
+	if hlp != nil {
+		webhookStorage, err = rpcservice.NewWebhookMgoStorage(hlp)
+		if err != nil {
+			fail(ErrorCodeInternalInitError, err.Error())
+		}
+	} else {
+		webhookStorage = rpcservice.NewWebhookMemoryStorage(trackingAge)
+	}
+	webhooks, err := rpcservice.NewWebhookNotifier(&rpcservice.WebhookOptions{DefaultUrl: *webhookUrl, Secret: *webhookSecret}, webhookStorage)
+	if err != nil {
+		fail(ErrorCodeInvalidArgs, fmt.Sprintf("Webhooks init failed. '%s'", err))
+	}
+	sender.Subscribe(webhooks.Notify)
 
 	s := rpc.NewServer()
 	s.RegisterCodec(gjson.NewCodec(), "application/json")
@@ -128,11 +303,42 @@ func main() {
 		fail(ErrorCodeInternalInitError, err.Error())
 	}
 
-	serv, err := rpcservice.NewSMSService(sender)
+	var incoming contract.IncomingContainer
+	if incomingEnabled {
+		incomingStorage, err := gosmsc.NewIncomingMgoStorage(hlp)
+		if err != nil {
+			fail(ErrorCodeInternalInitError, err.Error())
+		}
+		incoming = incomingStorage
+	}
+	var poller *gosmsc.IncomingPoller
+	if incomingInterval > 0 {
+		poller, err = gosmsc.StartIncomingPolling(opts, incoming, time.Millisecond*time.Duration(incomingInterval))
+		if err != nil {
+			fail(ErrorCodeInvalidConfig, fmt.Sprintf("Incoming polling init failed. '%s'", err))
+		}
+	}
+
+	serv, err := rpcservice.NewSMSServiceWithOptions(sender, &rpcservice.SMSServiceOptions{Webhooks: webhooks, Incoming: incoming})
 	s.RegisterService(serv, "")
 
 	http.Handle("/"+*rpcPath, s)
 
+	if len(*callbackPath) != 0 {
+		callbacks, err := sender.StatusCallbackHandler(*callbackSecret)
+		if err != nil {
+			fail(ErrorCodeInvalidArgs, fmt.Sprintf("Status callbacks init failed. '%s'", err))
+		}
+		http.Handle("/"+*callbackPath, callbacks)
+	}
+	if len(*incomingPath) != 0 {
+		callbacks, err := gosmsc.NewIncomingCallbackHandler(incoming, *callbackSecret)
+		if err != nil {
+			fail(ErrorCodeInvalidArgs, fmt.Sprintf("Incoming callbacks init failed. '%s'", err))
+		}
+		http.Handle("/"+*incomingPath, callbacks)
+	}
+
 	ml, err := s.ListMethods("SMSService")
 	if err != nil {
 		fail(ErrorCodeInternalInitError, err.Error())
@@ -148,27 +354,57 @@ func main() {
 	ch := make(chan os.Signal)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	writePid()
-	go signalHandle(ch)
+	server := &http.Server{Addr: ":" + *port}
+	stopped := make(chan bool)
+	go signalHandle(ch, server, stopped)
 
-	err = http.ListenAndServe(":"+*port, nil)
-	if err != nil {
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		fail(ErrorCodeInternalInitError, err.Error())
 	}
+	<-stopped
+	shutdown(poller, sender, webhooks, storage)
 }
 
-func signalHandle(ch chan os.Signal) {
-	for {
-		sig := <-ch
-		log.Debugf("Signal received: %v", sig)
+// signalHandle stops the server on a signal. Requests in progress are finished, so the sent messages are tracked
+// and their callback urls are registered.
+func signalHandle(ch chan os.Signal, server *http.Server, stopped chan bool) {
+	sig := <-ch
+	log.Debugf("Signal received: %v", sig)
 
-		err := os.Remove(pidFileName)
-		if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error(err)
+	}
+	close(stopped)
+}
+
+// shutdown stops the components in the order of their dependencies: the tracker publishes status events to
+// the webhooks, and all of them use the storage.
+func shutdown(poller *gosmsc.IncomingPoller, sender *gosmsc.SenderCheckerImpl, webhooks *rpcservice.WebhookNotifier,
+	storage contract.StatusContainer) {
+	if poller != nil {
+		poller.Stop()
+	}
+	if err := sender.Stop(); err != nil {
+		log.Error(err)
+	}
+	webhooks.Close()
+	// The bolt storage must be closed to release its file lock.
+	if closer, ok := storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
 			log.Error(err)
 		}
+	}
 
-		log.Flush()
-		os.Exit(1)
+	err := os.Remove(pidFileName)
+	if err != nil {
+		log.Error(err)
 	}
+
+	log.Flush()
+	os.Exit(1)
 }
 
 func writePid() {
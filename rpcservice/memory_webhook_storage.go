@@ -0,0 +1,108 @@
+package rpcservice
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWebhookMemoryMaxAge = 24 * time.Hour
+	webhookMemoryPruneInterval = time.Minute
+)
+
+type memoryCallbackKey struct {
+	messageId int64
+	gateway   string
+}
+
+type memoryCallbackUrl struct {
+	url       string
+	createdAt time.Time
+}
+
+// WebhookMemoryStorage is a WebhookStorage keeping everything in memory, for services running without a database.
+// Nothing survives a restart, so undelivered notifications are not redelivered. Delivered records are not kept,
+// callback urls and undelivered records are dropped when they get older than the max age.
+type WebhookMemoryStorage struct {
+	m          sync.Mutex
+	maxAge     time.Duration
+	urls       map[memoryCallbackKey]memoryCallbackUrl
+	deliveries map[string]WebhookDelivery
+	prunedAt   time.Time
+}
+
+// NewWebhookMemoryStorage creates an empty storage. Zero maxAge means DefaultWebhookMemoryMaxAge.
+func NewWebhookMemoryStorage(maxAge time.Duration) *WebhookMemoryStorage {
+	if maxAge <= 0 {
+		maxAge = DefaultWebhookMemoryMaxAge
+	}
+	return &WebhookMemoryStorage{
+		maxAge:     maxAge,
+		urls:       make(map[memoryCallbackKey]memoryCallbackUrl),
+		deliveries: make(map[string]WebhookDelivery),
+		prunedAt:   time.Now(),
+	}
+}
+
+func (ws *WebhookMemoryStorage) PutCallbackUrl(messageId int64, gateway string, url string) error {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	ws.prune()
+	ws.urls[memoryCallbackKey{messageId, gateway}] = memoryCallbackUrl{url, time.Now()}
+	return nil
+}
+
+func (ws *WebhookMemoryStorage) GetCallbackUrl(messageId int64, gateway string) (string, error) {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	return ws.urls[memoryCallbackKey{messageId, gateway}].url, nil
+}
+
+func (ws *WebhookMemoryStorage) PutDelivery(delivery *WebhookDelivery) error {
+	if delivery == nil {
+		return logger.Errorf("delivery is nil")
+	}
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	ws.prune()
+	if delivery.Delivered {
+		delete(ws.deliveries, delivery.Id)
+		return nil
+	}
+	ws.deliveries[delivery.Id] = *delivery
+	return nil
+}
+
+func (ws *WebhookMemoryStorage) GetUndelivered() ([]WebhookDelivery, error) {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	deliveries := make([]WebhookDelivery, 0, len(ws.deliveries))
+	for _, d := range ws.deliveries {
+		deliveries = append(deliveries, d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt)
+	})
+	return deliveries, nil
+}
+
+// prune drops the records older than the max age. It scans the maps at most once per webhookMemoryPruneInterval.
+func (ws *WebhookMemoryStorage) prune() {
+	now := time.Now()
+	if now.Sub(ws.prunedAt) < webhookMemoryPruneInterval {
+		return
+	}
+	ws.prunedAt = now
+	minCreatedAt := now.Add(-ws.maxAge)
+	for key, u := range ws.urls {
+		if u.createdAt.Before(minCreatedAt) {
+			delete(ws.urls, key)
+		}
+	}
+	for id, d := range ws.deliveries {
+		if d.CreatedAt.Before(minCreatedAt) {
+			delete(ws.deliveries, id)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package rpcservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookMemoryStorage(t *testing.T) {
+	ws := NewWebhookMemoryStorage(time.Hour)
+	if err := ws.PutCallbackUrl(1, "", "http://localhost/hook"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := ws.GetCallbackUrl(1, ""); u != "http://localhost/hook" {
+		t.Fatalf("Expected url = 'http://localhost/hook'. Got '%s'", u)
+	}
+	if u, _ := ws.GetCallbackUrl(1, "other"); len(u) != 0 {
+		t.Fatalf("Expected no url of the message of another gateway. Got '%s'", u)
+	}
+
+	now := time.Now()
+	d := &WebhookDelivery{Id: "1", MessageId: 1, Url: "http://localhost/hook", CreatedAt: now, UpdatedAt: now}
+	if err := ws.PutDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if undelivered, _ := ws.GetUndelivered(); len(undelivered) != 1 {
+		t.Fatalf("Expected 1 undelivered record. Got '%d'", len(undelivered))
+	}
+	d.Delivered = true
+	if err := ws.PutDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if undelivered, _ := ws.GetUndelivered(); len(undelivered) != 0 {
+		t.Fatalf("Expected 0 undelivered records. Got '%d'", len(undelivered))
+	}
+
+	// Records older than the max age are dropped.
+	ws.m.Lock()
+	ws.urls[memoryCallbackKey{1, ""}] = memoryCallbackUrl{"http://localhost/hook", now.Add(-2 * time.Hour)}
+	ws.prunedAt = now.Add(-2 * webhookMemoryPruneInterval)
+	ws.m.Unlock()
+	if err := ws.PutCallbackUrl(2, "", "http://localhost/hook"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := ws.GetCallbackUrl(1, ""); len(u) != 0 {
+		t.Fatalf("Expected url to be dropped. Got '%s'", u)
+	}
+}
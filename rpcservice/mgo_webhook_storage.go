@@ -0,0 +1,91 @@
+package rpcservice
+
+import (
+	"fmt"
+	mgohelper "github.com/goodsign/goutils/mgo"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	callbacksCollection  = "callbacks"
+	deliveriesCollection = "webhook_deliveries"
+)
+
+type callbackUrlRecord struct {
+	MessageId int64
+	Gateway   string
+	Url       string
+}
+
+// WebhookMgoStorage is a default mgo implementation of the WebhookStorage.
+type WebhookMgoStorage struct {
+	h *mgohelper.DbHelper
+}
+
+func NewWebhookMgoStorage(dbHelper *mgohelper.DbHelper) (*WebhookMgoStorage, error) {
+	if dbHelper == nil {
+		return nil, fmt.Errorf("dbHelper is nil")
+	}
+	return &WebhookMgoStorage{dbHelper}, nil
+}
+
+func (ws *WebhookMgoStorage) PutCallbackUrl(messageId int64, gateway string, url string) error {
+	logger.Tracef("messageId: '%d', gateway: '%s'", messageId, gateway)
+	c, s := ws.h.C(callbacksCollection)
+	defer s.Close()
+
+	_, err := c.Upsert(bson.M{"messageid": messageId, "gateway": gatewaySelector(gateway)},
+		&callbackUrlRecord{messageId, gateway, url})
+	return err
+}
+
+func (ws *WebhookMgoStorage) GetCallbackUrl(messageId int64, gateway string) (string, error) {
+	logger.Tracef("messageId: '%d', gateway: '%s'", messageId, gateway)
+	c, s := ws.h.C(callbacksCollection)
+	defer s.Close()
+
+	record := new(callbackUrlRecord)
+	err := c.Find(bson.M{"messageid": messageId, "gateway": gatewaySelector(gateway)}).One(record)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			return "", logger.Error(err)
+		}
+		return "", nil
+	}
+	return record.Url, nil
+}
+
+// gatewaySelector matches the gateway of the record. Records stored before the gateway was recorded
+// don't have the field, they are matched as messages sent without a composite provider.
+func gatewaySelector(gateway string) interface{} {
+	if len(gateway) == 0 {
+		return bson.M{"$in": []interface{}{"", nil}}
+	}
+	return gateway
+}
+
+func (ws *WebhookMgoStorage) PutDelivery(delivery *WebhookDelivery) error {
+	if delivery == nil {
+		return logger.Errorf("delivery is nil")
+	}
+	logger.Tracef("delivery id: '%s'", delivery.Id)
+	c, s := ws.h.C(deliveriesCollection)
+	defer s.Close()
+
+	_, err := c.Upsert(bson.M{"id": delivery.Id}, delivery)
+	return err
+}
+
+func (ws *WebhookMgoStorage) GetUndelivered() ([]WebhookDelivery, error) {
+	logger.Trace("")
+	c, s := ws.h.C(deliveriesCollection)
+	defer s.Close()
+
+	var deliveries []WebhookDelivery
+	err := c.Find(bson.M{"delivered": false}).Sort("createdat").All(&deliveries)
+	if err != nil {
+		return nil, logger.Error(err)
+	}
+	return deliveries, nil
+}
@@ -1,45 +1,127 @@
 package rpcservice
 
 import (
+	"errors"
 	"fmt"
 	"github.com/goodsign/gosmsc"
 	. "github.com/goodsign/gosmsc/contract"
+	"github.com/goodsign/gosmsc/segment"
 	"net/http"
 )
 
 //Service Definition
 type SMSService struct {
 	senderChecker *gosmsc.SenderCheckerImpl
+	opts          SMSServiceOptions
+}
+
+// SMSServiceOptions contains optional SMSService components. Nil components disable the
+// corresponding functionality.
+type SMSServiceOptions struct {
+	Webhooks *WebhookNotifier  // Registers callback urls of the sent messages
+	Incoming IncomingContainer // Stores messages received by the SMSC number
 }
 
 func NewSMSService(senderChecker *gosmsc.SenderCheckerImpl) (*SMSService, error) {
+	return NewSMSServiceWithOptions(senderChecker, nil)
+}
+
+func NewSMSServiceWithOptions(senderChecker *gosmsc.SenderCheckerImpl, opts *SMSServiceOptions) (*SMSService, error) {
 	if senderChecker == nil {
 		return nil, fmt.Errorf("nil senderChecker")
 	}
-	return &SMSService{senderChecker}, nil
+	if opts == nil {
+		opts = new(SMSServiceOptions)
+	}
+	return &SMSService{senderChecker, *opts}, nil
 }
 
 type Send_Args struct {
-	Phone string
-	Text  string
-	Track bool
+	Phone       string
+	Text        string
+	Track       bool
+	CallbackUrl string       // Optional url receiving status change notifications. Requires Track.
+	Options     *SendOptions // Optional send parameters
+
+	// ErrorReply is set by clients reading Send_Reply.Error. Gateway errors are returned as rpc errors to the
+	// clients which don't set it, so that they don't take the zero id for a sent message.
+	ErrorReply bool
 }
 type Send_Reply struct {
-	Id int64
+	Id    int64
+	Error *SmscError // Set instead of returning an rpc error if the gateway returned an error and ErrorReply is set
 }
 
 // SMSCClientInterface implementation
 func (h *SMSService) Send(r *http.Request, msg *Send_Args, reply *Send_Reply) error {
 	logger.Trace("")
 
-	id, err := h.senderChecker.Send(msg.Phone, msg.Text, msg.Track)
+	if len(msg.CallbackUrl) != 0 {
+		if !msg.Track {
+			return fmt.Errorf("Callback url requires tracking")
+		}
+		if h.opts.Webhooks == nil {
+			return fmt.Errorf("Webhooks are not configured")
+		}
+		if err := validateCallbackUrl(msg.CallbackUrl); err != nil {
+			return err
+		}
+	}
+
+	var register func(id int64, gateway string)
+	if len(msg.CallbackUrl) != 0 {
+		// The url is registered before the message is tracked, so its first status events go to this url.
+		register = func(id int64, gateway string) {
+			if err := h.opts.Webhooks.Register(id, gateway, msg.CallbackUrl); err != nil {
+				// Message is sent already, so the id is returned anyway.
+				logger.Errorf("Cannot register callback url of message %v: '%s'", id, err)
+			}
+		}
+	}
+	id, err := h.senderChecker.SendWithHookContext(r.Context(), msg.Phone, msg.Text, msg.Track, msg.Options, register)
 	if err != nil {
-		return err
+		if !msg.ErrorReply {
+			return err
+		}
+		return smscErrorReply(err, &reply.Error)
 	}
 	reply.Id = id
 	return nil
 }
 
+type SendBulk_Args struct {
+	Messages []BulkMessage
+	Track    bool
+	Options  *SendOptions // Optional send parameters
+}
+type SendBulk_Reply struct {
+	Results []BulkSendResult // Results in the order of messages
+	Error   *SmscError       // Set if sending stopped because of a gateway error
+	Failure string           // Set if sending stopped because of another error, e.g. a network one
+}
+
+// SendBulk sends messages to many recipients in batches. Gateway errors are returned per recipient. If sending
+// stops after some messages were sent, the error is returned in the reply along with the results, so the client
+// gets the ids of the sent messages and doesn't send them again. Rpc errors are returned only if nothing was sent.
+func (h *SMSService) SendBulk(r *http.Request, msg *SendBulk_Args, reply *SendBulk_Reply) error {
+	logger.Trace("")
+
+	results, err := h.senderChecker.SendBulkContext(r.Context(), msg.Messages, msg.Track, msg.Options)
+	reply.Results = results
+	if err == nil {
+		return nil
+	}
+	logger.Errorf("Bulk send failed: '%s'. Results: '%v'", err, results)
+	if results == nil {
+		// Local failure, e.g. invalid options. Nothing was sent.
+		return err
+	}
+	if err = smscErrorReply(err, &reply.Error); err != nil {
+		reply.Failure = err.Error()
+	}
+	return nil
+}
+
 type GetActualStatus_Args struct {
 	Id int64
 }
@@ -51,10 +133,119 @@ type GetActualStatus_Reply struct {
 func (h *SMSService) GetActualStatus(r *http.Request, msg *GetActualStatus_Args, reply *GetActualStatus_Reply) error {
 	logger.Trace("")
 
-	status, err := h.senderChecker.GetActualStatus(msg.Id)
+	status, err := h.senderChecker.GetActualStatusContext(r.Context(), msg.Id)
 	if err != nil {
 		return err
 	}
 	reply.Status = status
 	return nil
 }
+
+type AnalyzeText_Args struct {
+	Text string
+}
+type AnalyzeText_Reply struct {
+	Analysis *segment.Analysis
+}
+
+// AnalyzeText returns the encoding of the text and its parts. The gateway is not called.
+func (h *SMSService) AnalyzeText(r *http.Request, msg *AnalyzeText_Args, reply *AnalyzeText_Reply) error {
+	logger.Trace("")
+
+	reply.Analysis = segment.Analyze(msg.Text)
+	return nil
+}
+
+type Balance_Args struct{}
+type Balance_Reply struct {
+	Balance  float64
+	Currency string
+	Error    *SmscError
+}
+
+// Balance returns the account balance.
+func (h *SMSService) Balance(r *http.Request, msg *Balance_Args, reply *Balance_Reply) error {
+	logger.Trace("")
+
+	output, err := h.senderChecker.BalanceContext(r.Context())
+	if err != nil {
+		return smscErrorReply(err, &reply.Error)
+	}
+	reply.Balance = float64(output.Balance)
+	reply.Currency = output.Currency
+	return nil
+}
+
+type EstimateCost_Args struct {
+	Phone string
+	Text  string
+}
+type EstimateCost_Reply struct {
+	Cost  float64
+	Count int32 // Number of messages to be sent
+	Error *SmscError
+}
+
+// EstimateCost returns the cost of the message without sending it.
+func (h *SMSService) EstimateCost(r *http.Request, msg *EstimateCost_Args, reply *EstimateCost_Reply) error {
+	logger.Trace("")
+
+	output, err := h.senderChecker.EstimateCostContext(r.Context(), msg.Phone, msg.Text)
+	if err != nil {
+		return smscErrorReply(err, &reply.Error)
+	}
+	reply.Cost = float64(output.Cost)
+	reply.Count = output.Count
+	return nil
+}
+
+type ListIncoming_Args struct {
+	UnacknowledgedOnly bool
+	Limit              int // Zero means no limit
+}
+type ListIncoming_Reply struct {
+	Messages []IncomingMessage
+}
+
+// ListIncoming returns received messages in the order of receiving.
+func (h *SMSService) ListIncoming(r *http.Request, msg *ListIncoming_Args, reply *ListIncoming_Reply) error {
+	logger.Trace("")
+
+	if h.opts.Incoming == nil {
+		return fmt.Errorf("Incoming messages are not configured")
+	}
+	if msg.Limit < 0 {
+		return fmt.Errorf("Negative limit")
+	}
+	messages, err := h.opts.Incoming.ListIncoming(msg.UnacknowledgedOnly, msg.Limit)
+	if err != nil {
+		return err
+	}
+	reply.Messages = messages
+	return nil
+}
+
+type AcknowledgeIncoming_Args struct {
+	Ids []int64
+}
+type AcknowledgeIncoming_Reply struct{}
+
+// AcknowledgeIncoming marks received messages as processed, so they are not listed as unacknowledged anymore.
+func (h *SMSService) AcknowledgeIncoming(r *http.Request, msg *AcknowledgeIncoming_Args, reply *AcknowledgeIncoming_Reply) error {
+	logger.Trace("")
+
+	if h.opts.Incoming == nil {
+		return fmt.Errorf("Incoming messages are not configured")
+	}
+	return h.opts.Incoming.AcknowledgeIncoming(msg.Ids)
+}
+
+// smscErrorReply puts the gateway error into the reply field. Other errors are returned as rpc errors.
+func smscErrorReply(err error, replyError **SmscError) error {
+	var smscErr *SmscError
+	if errors.As(err, &smscErr) {
+		*replyError = smscErr
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package rpcservice
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/goodsign/gosmsc"
+	. "github.com/goodsign/gosmsc/contract"
+	"github.com/goodsign/gosmsc/phone"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendBulkPartialFailure(t *testing.T) {
+	var m sync.Mutex
+	calls := 0
+	// The first batch is sent, the second one fails.
+	g := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		calls++
+		call := calls
+		m.Unlock()
+		if call > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"id":5,"cnt":1}`))
+	}))
+	defer g.Close()
+
+	storage, err := gosmsc.NewMemoryStatusStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := gosmsc.NewSenderCheckerImplWithOptions(&gosmsc.SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL},
+		storage, time.Hour, &gosmsc.SenderCheckerOptions{BulkBatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv, err := NewSMSService(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := &SendBulk_Args{Messages: []BulkMessage{{Phone: "79211234567", Text: "first"}, {Phone: "79211234568", Text: "second"}}}
+	reply := new(SendBulk_Reply)
+	if err = serv.SendBulk(httptest.NewRequest("POST", "/rpc", nil), args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Results) != 2 || reply.Results[0].Id != 5 || reply.Results[1].Id != 0 {
+		t.Fatalf("Unexpected results: '%v'", reply.Results)
+	}
+	if len(reply.Failure) == 0 {
+		t.Fatal("Expected the failure to be returned")
+	}
+}
+
+func TestSendErrorReply(t *testing.T) {
+	storage, err := gosmsc.NewMemoryStatusStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := gosmsc.NewSenderCheckerImpl(&gosmsc.SmscClientOptions{User: "user", Password: "pwd"}, storage, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv, err := NewSMSService(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients which don't read the reply error get an rpc error.
+	args := &Send_Args{Phone: "123", Text: "test"}
+	reply := new(Send_Reply)
+	if err = serv.Send(httptest.NewRequest("POST", "/rpc", nil), args, reply); !errors.Is(err, ErrInvalidPhoneFormat) {
+		t.Fatalf("Expected to get '%s'. Got '%v'", ErrInvalidPhoneFormat, err)
+	}
+
+	args.ErrorReply = true
+	if err = serv.Send(httptest.NewRequest("POST", "/rpc", nil), args, reply); err != nil {
+		t.Fatal(err)
+	}
+	// The local cause is matched after the reply is sent over rpc.
+	data, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := new(Send_Reply)
+	if err = json.Unmarshal(data, received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Error == nil || !errors.Is(received.Error, ErrInvalidPhoneFormat) || !errors.Is(received.Error, phone.ErrInvalidPhone) {
+		t.Fatalf("Expected to get '%s'. Got '%v'", phone.ErrInvalidPhone, received.Error)
+	}
+}
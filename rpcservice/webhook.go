@@ -0,0 +1,297 @@
+package rpcservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/goodsign/gosmsc"
+	. "github.com/goodsign/gosmsc/contract"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	WebhookSignatureHeader = "X-Smsc-Signature"
+	DefaultWebhookAttempts = 5
+	DefaultWebhookWorkers  = 4
+	DefaultWebhookTimeout  = 10 * time.Second
+	webhookQueueSize       = 1000
+)
+
+// WebhookNotification is the JSON body posted to the callback url when a message status changes.
+type WebhookNotification struct {
+	MessageId  int64             `json:"id"`
+	Phone      string            `json:"phone"`
+	Gateway    string            `json:"gateway,omitempty"` // See MessageStatus.Gateway
+	OldStatus  MessageStatusCode `json:"old_status"`
+	Status     MessageStatusCode `json:"status"`
+	StatusName string            `json:"status_name"`
+	Final      bool              `json:"final"`
+	Delivered  bool              `json:"delivered"`
+	Operator   string            `json:"operator"`
+	ErrorCode  int32             `json:"error_code"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// WebhookDelivery is a delivery log record of a single notification.
+type WebhookDelivery struct {
+	Id        string // Unique delivery id
+	MessageId int64
+	Url       string
+	Payload   string
+	Attempts  int
+	Delivered bool
+	LastError string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// WebhookStorage persists callback urls of the messages and the webhook delivery log. Message ids are unique
+// per gateway only, so callback urls are identified by the message id and gateway (see MessageStatus.Gateway).
+type WebhookStorage interface {
+	PutCallbackUrl(messageId int64, gateway string, url string) error // Overwrites the url if it is already set
+	GetCallbackUrl(messageId int64, gateway string) (string, error)   // Returns empty url if it was not set
+	PutDelivery(delivery *WebhookDelivery) error                      // Inserts or overwrites the record by its Id
+	GetUndelivered() ([]WebhookDelivery, error)                       // Returns the records which are not Delivered
+}
+
+// WebhookOptions configures the webhook notifier. Zero values mean defaults.
+type WebhookOptions struct {
+	// DefaultUrl receives notifications of messages sent without a callback url. Empty url disables them.
+	DefaultUrl string
+
+	// Secret is used to sign notifications: WebhookSignatureHeader contains 'sha256=' followed by
+	// hex HMAC-SHA256 of the body. Empty secret disables signing.
+	Secret string
+
+	// Retry defines redelivery of failed notifications. MaxAttempts defaults to DefaultWebhookAttempts.
+	Retry gosmsc.RetryPolicy
+
+	Workers    int           // Number of concurrent deliveries. Defaults to DefaultWebhookWorkers.
+	Timeout    time.Duration // Timeout of a single delivery attempt. Defaults to DefaultWebhookTimeout.
+	HttpClient *http.Client  // Overrides Timeout if set
+}
+
+// WebhookNotifier posts status change notifications of the tracked messages to the callback urls.
+// Use its Notify func as a tracker status listener (see gosmsc.SenderCheckerImpl.Subscribe). Undelivered
+// notifications left in the delivery log, e.g. by a restart, are redelivered when the notifier is created.
+type WebhookNotifier struct {
+	opts    WebhookOptions
+	storage WebhookStorage
+	client  *http.Client
+	queue   chan *WebhookDelivery
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewWebhookNotifier(opts *WebhookOptions, storage WebhookStorage) (*WebhookNotifier, error) {
+	if opts == nil {
+		return nil, fmt.Errorf("nil opts")
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("nil storage")
+	}
+	if len(opts.DefaultUrl) != 0 {
+		if err := validateCallbackUrl(opts.DefaultUrl); err != nil {
+			return nil, err
+		}
+	}
+
+	n := &WebhookNotifier{opts: *opts, storage: storage, queue: make(chan *WebhookDelivery, webhookQueueSize)}
+	if n.opts.Retry.MaxAttempts == 0 {
+		n.opts.Retry.MaxAttempts = DefaultWebhookAttempts
+	}
+	if n.opts.Workers <= 0 {
+		n.opts.Workers = DefaultWebhookWorkers
+	}
+	if n.opts.Timeout <= 0 {
+		n.opts.Timeout = DefaultWebhookTimeout
+	}
+	n.client = n.opts.HttpClient
+	if n.client == nil {
+		n.client = &http.Client{Timeout: n.opts.Timeout}
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	undelivered, err := storage.GetUndelivered()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < n.opts.Workers; i++ {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			for {
+				select {
+				case d := <-n.queue:
+					n.deliver(d)
+				case <-n.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go n.replay(undelivered)
+	return n, nil
+}
+
+// replay queues the undelivered notifications which have attempts left.
+func (n *WebhookNotifier) replay(deliveries []WebhookDelivery) {
+	for i := range deliveries {
+		d := &deliveries[i]
+		if d.Attempts >= n.opts.Retry.MaxAttempts {
+			continue
+		}
+		logger.Infof("Redelivering webhook '%s'", d.Id)
+		select {
+		case n.queue <- d:
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// Register sets the callback url of the message sent through the gateway. Notifications of the message go to this
+// url instead of the default one.
+func (n *WebhookNotifier) Register(messageId int64, gateway string, callbackUrl string) error {
+	if err := validateCallbackUrl(callbackUrl); err != nil {
+		return err
+	}
+	return n.storage.PutCallbackUrl(messageId, gateway, callbackUrl)
+}
+
+// Notify queues the notification of the status change for delivery. It is a gosmsc.StatusListener.
+func (n *WebhookNotifier) Notify(event StatusEvent) {
+	callbackUrl, err := n.storage.GetCallbackUrl(event.MessageId, event.Gateway)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if len(callbackUrl) == 0 {
+		callbackUrl = n.opts.DefaultUrl
+	}
+	if len(callbackUrl) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(&WebhookNotification{
+		MessageId:  event.MessageId,
+		Phone:      event.Phone,
+		Gateway:    event.Gateway,
+		OldStatus:  event.OldStatusCode,
+		Status:     event.NewStatusCode,
+		StatusName: event.NewStatusCode.String(),
+		Final:      event.NewStatusCode.IsFinal(),
+		Delivered:  event.NewStatusCode.IsDelivered(),
+		Operator:   event.Operator,
+		ErrorCode:  event.StatusErrorCode,
+		Timestamp:  event.Timestamp,
+	})
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	now := time.Now()
+	d := &WebhookDelivery{
+		Id:        fmt.Sprintf("%d-%d-%d", event.MessageId, event.NewStatusCode, now.UnixNano()),
+		MessageId: event.MessageId,
+		Url:       callbackUrl,
+		Payload:   string(payload),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err = n.storage.PutDelivery(d); err != nil {
+		logger.Error(err)
+	}
+	select {
+	case n.queue <- d:
+	case <-n.ctx.Done():
+	}
+}
+
+// Close stops delivery. Queued notifications and the ones that are being retried are abandoned, their state
+// stays in the delivery log. The queue is not closed, so Notify called concurrently doesn't panic.
+func (n *WebhookNotifier) Close() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+// deliver posts the notification until it succeeds or attempts are exhausted, logging each attempt.
+func (n *WebhookNotifier) deliver(d *WebhookDelivery) {
+	for {
+		d.Attempts++
+		err := n.post(d)
+		d.UpdatedAt = time.Now()
+		if err == nil {
+			d.Delivered = true
+			d.LastError = ""
+		} else {
+			d.LastError = err.Error()
+			logger.Warnf("Webhook delivery '%s' attempt %d failed: '%s'", d.Id, d.Attempts, err)
+		}
+		if perr := n.storage.PutDelivery(d); perr != nil {
+			logger.Error(perr)
+		}
+		if d.Delivered || d.Attempts >= n.opts.Retry.MaxAttempts {
+			return
+		}
+
+		timer := time.NewTimer(n.opts.Retry.Backoff(d.Attempts))
+		select {
+		case <-timer.C:
+		case <-n.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (n *WebhookNotifier) post(d *WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(n.ctx, "POST", d.Url, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.opts.Secret) != 0 {
+		req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(n.opts.Secret, []byte(d.Payload)))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Callback responded with http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the signature header value of the payload. Receivers can use it
+// to verify notifications.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validateCallbackUrl(callbackUrl string) error {
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("Invalid callback url: '%s'", callbackUrl)
+	}
+	return nil
+}
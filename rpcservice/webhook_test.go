@@ -0,0 +1,198 @@
+package rpcservice
+
+import (
+	"encoding/json"
+	. "github.com/goodsign/gosmsc/contract"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookTestStorage struct {
+	m          sync.Mutex
+	urls       map[memoryCallbackKey]string
+	deliveries map[string]WebhookDelivery
+}
+
+func newWebhookTestStorage() *webhookTestStorage {
+	return &webhookTestStorage{urls: make(map[memoryCallbackKey]string), deliveries: make(map[string]WebhookDelivery)}
+}
+
+func (ws *webhookTestStorage) PutCallbackUrl(messageId int64, gateway string, url string) error {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	ws.urls[memoryCallbackKey{messageId, gateway}] = url
+	return nil
+}
+
+func (ws *webhookTestStorage) GetCallbackUrl(messageId int64, gateway string) (string, error) {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	return ws.urls[memoryCallbackKey{messageId, gateway}], nil
+}
+
+func (ws *webhookTestStorage) PutDelivery(delivery *WebhookDelivery) error {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	ws.deliveries[delivery.Id] = *delivery
+	return nil
+}
+
+func (ws *webhookTestStorage) GetUndelivered() ([]WebhookDelivery, error) {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	var deliveries []WebhookDelivery
+	for _, d := range ws.deliveries {
+		if !d.Delivered {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (ws *webhookTestStorage) delivery() (WebhookDelivery, bool) {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	for _, d := range ws.deliveries {
+		return d, true
+	}
+	return WebhookDelivery{}, false
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var m sync.Mutex
+	calls := 0
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		calls++
+		first := calls == 1
+		m.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	storage := newWebhookTestStorage()
+	opts := &WebhookOptions{Secret: "secret"}
+	opts.Retry.InitialBackoff = time.Millisecond
+	n, err := NewWebhookNotifier(opts, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if err = n.Register(1, "", srv.URL+"/hook"); err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(StatusEvent{MessageId: 2, NewStatusCode: MessageStatusComplete})                   // No url, ignored
+	n.Notify(StatusEvent{MessageId: 1, Gateway: "other", NewStatusCode: MessageStatusComplete}) // Another message, ignored
+	n.Notify(StatusEvent{MessageId: 1, OldStatusCode: MessageStatusCodeUnknown, NewStatusCode: MessageStatusComplete})
+
+	var r *http.Request
+	var body []byte
+	select {
+	case r = <-received:
+		body = <-bodies
+	case <-time.After(time.Second):
+		t.Fatal("Notification wasn't delivered")
+	}
+	if sig := r.Header.Get(WebhookSignatureHeader); sig != SignWebhookPayload("secret", body) {
+		t.Fatalf("Invalid signature: '%s'", sig)
+	}
+	notification := new(WebhookNotification)
+	if err = json.Unmarshal(body, notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.MessageId != 1 || notification.Status != MessageStatusComplete || !notification.Delivered {
+		t.Fatalf("Unexpected notification: '%v'", notification)
+	}
+
+	// Delivery log is updated right after the response.
+	for i := 0; i < 100; i++ {
+		if d, ok := storage.delivery(); ok && d.Delivered {
+			if d.Attempts != 2 {
+				t.Fatalf("Expected 2 attempts. Got '%d'", d.Attempts)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Delivery wasn't logged")
+}
+
+func TestInvalidCallbackUrl(t *testing.T) {
+	n, err := NewWebhookNotifier(&WebhookOptions{}, newWebhookTestStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	for _, u := range []string{"", "ftp://host/path", "not a url", "http://"} {
+		if err = n.Register(1, "", u); err == nil {
+			t.Fatalf("Expected url '%s' to be rejected", u)
+		}
+	}
+}
+
+func TestWebhookReplay(t *testing.T) {
+	received := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- body
+	}))
+	defer srv.Close()
+
+	// Deliveries left undelivered by the previous run.
+	storage := newWebhookTestStorage()
+	storage.PutDelivery(&WebhookDelivery{Id: "1", MessageId: 1, Url: srv.URL, Payload: `{"id":1}`, Attempts: 1})
+	storage.PutDelivery(&WebhookDelivery{Id: "2", MessageId: 2, Url: srv.URL, Payload: `{"id":2}`, Attempts: DefaultWebhookAttempts})
+	storage.PutDelivery(&WebhookDelivery{Id: "3", MessageId: 3, Url: srv.URL, Payload: `{"id":3}`, Delivered: true})
+
+	n, err := NewWebhookNotifier(&WebhookOptions{}, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	select {
+	case body := <-received:
+		if string(body) != `{"id":1}` {
+			t.Fatalf("Expected delivery 1 to be replayed. Got '%s'", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Undelivered notification wasn't replayed")
+	}
+	select {
+	case body := <-received:
+		t.Fatalf("Expected only delivery 1 to be replayed. Got '%s'", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotifyAfterClose(t *testing.T) {
+	n, err := NewWebhookNotifier(&WebhookOptions{DefaultUrl: "http://127.0.0.1:1/hook"}, newWebhookTestStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n.Notify(StatusEvent{MessageId: int64(i), NewStatusCode: MessageStatusComplete})
+		}(i)
+	}
+	n.Close()
+	wg.Wait()
+	// Notify after Close must not block or panic.
+	n.Notify(StatusEvent{MessageId: 100, NewStatusCode: MessageStatusComplete})
+}
@@ -0,0 +1,111 @@
+// Package segment analyzes how a text is encoded and split into parts when it is sent as sms.
+//
+// Texts consisting of GSM 03.38 characters are sent in GSM-7 encoding: up to 160 septets in a single
+// sms or 153 septets per part of a concatenated one. Extension table characters take two septets.
+// Other texts are sent in UCS-2: up to 70 code units in a single sms or 67 per part. Characters
+// outside the Basic Multilingual Plane take two code units. Characters are never split between parts.
+package segment
+
+import (
+	"strings"
+)
+
+// Encoding of an sms text.
+type Encoding string
+
+const (
+	GSM7 Encoding = "GSM-7"
+	UCS2 Encoding = "UCS-2"
+)
+
+// Part limits in encoding units (septets for GSM-7, UTF-16 code units for UCS-2).
+const (
+	GSM7SingleLimit    = 160
+	GSM7MultipartLimit = 153
+	UCS2SingleLimit    = 70
+	UCS2MultipartLimit = 67
+)
+
+const (
+	gsm7Basic     = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extension = "\f^{}\\[~]|€"
+)
+
+// Part is a part of a text sent as one sms.
+type Part struct {
+	Start  int // Offset of the first character of the part in the text, in runes
+	End    int // Offset after the last character of the part, in runes
+	Length int // Part length in encoding units
+}
+
+// Analysis describes how a text is sent.
+type Analysis struct {
+	Encoding Encoding
+	Length   int    // Text length in encoding units
+	Parts    []Part // Empty for an empty text
+}
+
+// PartCount returns the number of sms the text is sent as.
+func (a *Analysis) PartCount() int {
+	return len(a.Parts)
+}
+
+// Analyze determines the encoding of the text and splits it into parts.
+func Analyze(text string) *Analysis {
+	a := &Analysis{Encoding: GSM7}
+	for _, r := range text {
+		if unitLength(GSM7, r) == 0 {
+			a.Encoding = UCS2
+			break
+		}
+	}
+
+	runes := []rune(text)
+	for _, r := range runes {
+		a.Length += unitLength(a.Encoding, r)
+	}
+	if len(runes) == 0 {
+		return a
+	}
+
+	single, multipart := GSM7SingleLimit, GSM7MultipartLimit
+	if a.Encoding == UCS2 {
+		single, multipart = UCS2SingleLimit, UCS2MultipartLimit
+	}
+	if a.Length <= single {
+		a.Parts = []Part{{0, len(runes), a.Length}}
+		return a
+	}
+
+	part := Part{}
+	for i, r := range runes {
+		l := unitLength(a.Encoding, r)
+		if part.Length+l > multipart {
+			part.End = i
+			a.Parts = append(a.Parts, part)
+			part = Part{Start: i}
+		}
+		part.Length += l
+	}
+	part.End = len(runes)
+	a.Parts = append(a.Parts, part)
+	return a
+}
+
+// unitLength returns the number of encoding units the character takes. Returns zero for GSM-7 if
+// the character cannot be encoded.
+func unitLength(encoding Encoding, r rune) int {
+	if encoding == UCS2 {
+		if r > 0xFFFF {
+			return 2
+		}
+		return 1
+	}
+	if strings.ContainsRune(gsm7Basic, r) {
+		return 1
+	}
+	if strings.ContainsRune(gsm7Extension, r) {
+		return 2
+	}
+	return 0
+}
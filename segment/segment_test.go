@@ -0,0 +1,71 @@
+package segment
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	cases := []struct {
+		text     string
+		encoding Encoding
+		length   int
+		parts    int
+	}{
+		{"", GSM7, 0, 0},
+		{"Hello", GSM7, 5, 1},
+		{strings.Repeat("a", 160), GSM7, 160, 1},
+		{strings.Repeat("a", 161), GSM7, 161, 2},
+		{strings.Repeat("a", 306), GSM7, 306, 2},
+		{strings.Repeat("a", 307), GSM7, 307, 3},
+		{strings.Repeat("€", 80), GSM7, 160, 1},
+		{strings.Repeat("€", 81), GSM7, 162, 2},
+		{"Price: 10€ [approx]", GSM7, 22, 1},
+		{"Привет", UCS2, 6, 1},
+		{strings.Repeat("я", 70), UCS2, 70, 1},
+		{strings.Repeat("я", 71), UCS2, 71, 2},
+		{strings.Repeat("я", 134), UCS2, 134, 2},
+		{strings.Repeat("я", 135), UCS2, 135, 3},
+		{strings.Repeat("a", 159) + "я", UCS2, 160, 3},
+		{"😀", UCS2, 2, 1},
+	}
+	for _, c := range cases {
+		a := Analyze(c.text)
+		if a.Encoding != c.encoding || a.Length != c.length || a.PartCount() != c.parts {
+			t.Fatalf("Expected '%s' to be %s of length %d in %d parts. Got %s of length %d in %d parts",
+				c.text, c.encoding, c.length, c.parts, a.Encoding, a.Length, a.PartCount())
+		}
+	}
+}
+
+func TestPartBoundaries(t *testing.T) {
+	// An extension character doesn't fit the first part and moves to the second one.
+	text := strings.Repeat("a", 152) + "€" + strings.Repeat("b", 10)
+	a := Analyze(text)
+	if a.PartCount() != 2 {
+		t.Fatalf("Expected 2 parts. Got '%d'", a.PartCount())
+	}
+	if a.Parts[0].End != 152 || a.Parts[0].Length != 152 || a.Parts[1].Start != 152 || a.Parts[1].Length != 12 {
+		t.Fatalf("Unexpected parts: '%v'", a.Parts)
+	}
+
+	// A surrogate pair is not split.
+	text = strings.Repeat("я", 66) + "😀" + strings.Repeat("я", 5)
+	a = Analyze(text)
+	if a.Parts[0].End != 66 || a.Parts[1].Start != 66 || a.Parts[1].End != 72 || a.Parts[1].Length != 7 {
+		t.Fatalf("Unexpected parts: '%v'", a.Parts)
+	}
+
+	runes := []rune(strings.Repeat("Длинное сообщение ", 20))
+	a = Analyze(string(runes))
+	end := 0
+	for _, p := range a.Parts {
+		if p.Start != end || p.Length > UCS2MultipartLimit {
+			t.Fatalf("Unexpected parts: '%v'", a.Parts)
+		}
+		end = p.End
+	}
+	if end != len(runes) {
+		t.Fatalf("Expected parts to cover the text of length %d. Got '%d'", len(runes), end)
+	}
+}
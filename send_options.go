@@ -0,0 +1,52 @@
+package gosmsc
+
+import (
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	MinMessageValidity = time.Minute
+	MaxMessageValidity = 24 * time.Hour
+)
+
+// validateSendOptions checks the options before the message is sent. Nil options are valid.
+func validateSendOptions(opts *SendOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.Valid != 0 && (opts.Valid < MinMessageValidity || opts.Valid > MaxMessageValidity) {
+		return fmt.Errorf("Message validity must be from %v to %v. Got %v", MinMessageValidity, MaxMessageValidity, opts.Valid)
+	}
+	return nil
+}
+
+// setSendOptions adds the gateway parameters corresponding to the options.
+func setSendOptions(v url.Values, opts *SendOptions) {
+	if opts == nil {
+		return
+	}
+	if len(opts.Sender) != 0 {
+		v.Set("sender", opts.Sender)
+	}
+	if !opts.Time.IsZero() {
+		// '0' prefix means the time is a unix timestamp.
+		v.Set("time", "0"+strconv.FormatInt(opts.Time.Unix(), 10))
+	}
+	if opts.Valid != 0 {
+		minutes := int(opts.Valid / time.Minute)
+		v.Set("valid", fmt.Sprintf("%02d:%02d", minutes/60, minutes%60))
+	}
+	if opts.Translit {
+		v.Set("translit", "1")
+	}
+	if opts.Flash {
+		v.Set("flash", "1")
+	}
+	if opts.TinyUrl {
+		v.Set("tinyurl", "1")
+	}
+}
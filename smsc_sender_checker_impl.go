@@ -1,14 +1,92 @@
 package gosmsc
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	. "github.com/goodsign/gosmsc/contract"
+	phonenum "github.com/goodsign/gosmsc/phone"
+	"github.com/goodsign/gosmsc/segment"
+	"net/http"
+	"sync"
 	"time"
 )
 
+const (
+	DefaultBalanceCheckInterval = time.Minute
+	DefaultBulkBatchSize        = 100
+)
+
+var (
+	ErrBalanceTooLow = errors.New("Balance is below the configured minimum")
+	ErrTooManyParts  = errors.New("Text exceeds the max number of parts")
+)
+
+// Local causes of SmscErrors are matched by rpc clients with errors.Is.
+func init() {
+	RegisterLocalError("invalid_phone", phonenum.ErrInvalidPhone)
+	RegisterLocalError("too_many_parts", ErrTooManyParts)
+}
+
 // SmscClientOptions encapsulates configuration used to send sms messages using smsc.ru
+//
+// Either ApiKey or User and Password must be set. Use String() to log options, it hides the secrets.
 type SmscClientOptions struct {
 	User     string `json:"user"`
 	Password string `json:"pwd"`
+
+	// HashPassword makes the client send md5 hash of the Password instead of the plain password.
+	HashPassword bool `json:"hash_pwd"`
+
+	// ApiKey is used instead of User and Password if set.
+	ApiKey string `json:"apikey"`
+
+	// BaseUrl is the gateway root, e.g. 'https://smsc.kz/' for a regional mirror or a
+	// local fake gateway address in tests. Defaults to DefaultSmscBaseUrl.
+	BaseUrl string `json:"url"`
+
+	// Timeout limits the time of each gateway request. Zero means no timeout.
+	// Ignored if HttpClient is set.
+	Timeout time.Duration `json:"-"`
+
+	// TLSConfig and InsecureSkipVerify customize TLS of the default transport.
+	// Ignored if HttpClient or Transport is set.
+	TLSConfig          *tls.Config `json:"-"`
+	InsecureSkipVerify bool        `json:"insecure"`
+
+	// Transport is used instead of http.DefaultTransport if set (e.g. to use an egress proxy).
+	// Ignored if HttpClient is set.
+	Transport http.RoundTripper `json:"-"`
+
+	// HttpClient is used for all gateway calls if set. Overrides all other transport settings.
+	HttpClient *http.Client `json:"-"`
+
+	// Retry enables retries of failed gateway calls. Nil means no retries.
+	Retry *RetryPolicy `json:"-"`
+
+	// RequestsPerSecond limits the rate of all gateway calls (sends and status polls) made by the client,
+	// allowing bursts of up to Burst requests. Zero means no limit.
+	RequestsPerSecond float64 `json:"rps"`
+	Burst             int     `json:"burst"`
+}
+
+// SenderCheckerOptions contains optional SenderCheckerImpl settings. Zero values mean defaults.
+type SenderCheckerOptions struct {
+	Tracker TrackerOptions // Settings of the tracker goroutine
+
+	// MinBalance makes Send fail with ErrBalanceTooLow without calling the gateway when the account balance
+	// is below it. Zero disables the check. The balance is requested at most once per BalanceCheckInterval,
+	// zero interval means DefaultBalanceCheckInterval.
+	MinBalance           float64
+	BalanceCheckInterval time.Duration
+
+	// MaxParts makes Send fail with ErrTooManyParts without calling the gateway if the text is longer than
+	// MaxParts sms (see segment.Analyze). The text is analyzed before transliteration. Zero means no limit.
+	MaxParts int
+
+	// BulkBatchSize is the max number of recipients in one gateway call made by SendBulk. Zero means DefaultBulkBatchSize.
+	BulkBatchSize int
 }
 
 // HttpSenderChecker provides the functionality to send sms and track its status.
@@ -24,9 +102,16 @@ type SenderCheckerImpl struct {
 	storage       StatusContainer
 	statusFetcher StatusFetcher
 	tracker       *MessageTracker
+	opts          SenderCheckerOptions
+	balanceM      sync.Mutex
+	balance       Amount        // Last known balance. Used only if MinBalance is set
+	balanceErr    error         // Error of the last balance request
+	balanceAt     time.Time     // Time of the last balance request
+	balanceFetch  chan struct{} // Closed when the balance request in progress is over, nil if there is none
 }
 
-func newSenderCheckerImplInternal(sender Sender, statusFetcher StatusFetcher, storage StatusContainer, updateInterval time.Duration) (*SenderCheckerImpl, error) {
+func newSenderCheckerImplInternal(sender Sender, statusFetcher StatusFetcher, storage StatusContainer, updateInterval time.Duration,
+	checkerOpts *SenderCheckerOptions) (*SenderCheckerImpl, error) {
 	if sender == nil {
 		return nil, logger.Error("sender cannot be nil")
 	}
@@ -43,12 +128,29 @@ func newSenderCheckerImplInternal(sender Sender, statusFetcher StatusFetcher, st
 		return nil, logger.Error("updateInterval cannot be zero or negative")
 	}
 
+	if checkerOpts == nil {
+		checkerOpts = new(SenderCheckerOptions)
+	}
+
+	if checkerOpts.MinBalance < 0 || checkerOpts.BalanceCheckInterval < 0 {
+		return nil, logger.Error("MinBalance and BalanceCheckInterval cannot be negative")
+	}
+
+	if checkerOpts.BulkBatchSize < 0 || checkerOpts.MaxParts < 0 {
+		return nil, logger.Error("BulkBatchSize and MaxParts cannot be negative")
+	}
+
+	if _, ok := sender.(AccountFetcher); checkerOpts.MinBalance > 0 && !ok {
+		return nil, logger.Error("MinBalance requires a sender supporting balance requests")
+	}
+
 	impl := new(SenderCheckerImpl)
 	impl.sender = sender
 	impl.storage = storage
 	impl.statusFetcher = statusFetcher
+	impl.opts = *checkerOpts
 
-	t, err := StartTracking(storage, statusFetcher, updateInterval)
+	t, err := StartTrackingWithOptions(storage, statusFetcher, updateInterval, &checkerOpts.Tracker)
 	if err != nil {
 		return nil, err
 	}
@@ -59,24 +161,87 @@ func newSenderCheckerImplInternal(sender Sender, statusFetcher StatusFetcher, st
 }
 
 func NewSenderCheckerImpl(opts *SmscClientOptions, storage StatusContainer, updateInterval time.Duration) (*SenderCheckerImpl, error) {
+	return NewSenderCheckerImplWithOptions(opts, storage, updateInterval, nil)
+}
+
+// NewSenderCheckerImplWithOptions is the same as NewSenderCheckerImpl, but also accepts optional settings.
+// Nil checkerOpts are equal to zero SenderCheckerOptions.
+func NewSenderCheckerImplWithOptions(opts *SmscClientOptions, storage StatusContainer, updateInterval time.Duration,
+	checkerOpts *SenderCheckerOptions) (*SenderCheckerImpl, error) {
 	sint, err := newSmsClientInternal(opts)
 	if err != nil {
 		return nil, err
 	}
-	return newSenderCheckerImplInternal(sint, sint, storage, updateInterval)
+	return newSenderCheckerImplInternal(sint, sint, storage, updateInterval, checkerOpts)
+}
+
+// NewSenderCheckerImplWithProvider is the same as NewSenderCheckerImplWithOptions, but sends and tracks messages
+// using any Provider, e.g. an HttpProvider. Bulk sends are made one by one, balance requests are not supported.
+func NewSenderCheckerImplWithProvider(provider Provider, storage StatusContainer, updateInterval time.Duration,
+	checkerOpts *SenderCheckerOptions) (*SenderCheckerImpl, error) {
+	if provider == nil {
+		return nil, logger.Error("provider cannot be nil")
+	}
+	client := &providerClient{provider}
+	return newSenderCheckerImplInternal(client, client, storage, updateInterval, checkerOpts)
 }
 
 func (c *SenderCheckerImpl) Send(phone string, text string, track bool) (int64, error) {
-	output, err := c.sender.Send(phone, text)
+	return c.SendContext(context.Background(), phone, text, track)
+}
+
+func (c *SenderCheckerImpl) SendContext(ctx context.Context, phone string, text string, track bool) (int64, error) {
+	return c.SendWithOptionsContext(ctx, phone, text, track, nil)
+}
+
+// SendWithOptions is the same as Send, but also accepts optional send parameters. Nil opts are equal to
+// zero SendOptions. The options are stored with the tracked message status.
+func (c *SenderCheckerImpl) SendWithOptions(phone string, text string, track bool, opts *SendOptions) (int64, error) {
+	return c.SendWithOptionsContext(context.Background(), phone, text, track, opts)
+}
+
+func (c *SenderCheckerImpl) SendWithOptionsContext(ctx context.Context, phone string, text string, track bool, opts *SendOptions) (int64, error) {
+	return c.SendWithHookContext(ctx, phone, text, track, opts, nil)
+}
+
+// SendWithHookContext is SendWithOptionsContext calling beforeTrack (if not nil) with the id and the gateway
+// (see MessageStatus.Gateway) of the sent message before the message is tracked. No status events of the message are published until beforeTrack returns, so
+// it can e.g. register the callback url of the message.
+func (c *SenderCheckerImpl) SendWithHookContext(ctx context.Context, phone string, text string, track bool, opts *SendOptions,
+	beforeTrack func(id int64, gateway string)) (int64, error) {
+	phone, err := phonenum.Normalize(phone)
 	if err != nil {
-		return -1, logger.Error(err)
+		return -1, ErrInvalidPhoneFormat.Wrap(err)
 	}
-	if output.Error != "" {
-		return -1, logger.Errorf("[%v] %s", output.ErrorCode, output.Error)
+	if err = validateSendOptions(opts); err != nil {
+		return -1, err
+	}
+	parts, err := c.checkParts(text)
+	if err != nil {
+		return -1, err
+	}
+	if err = c.checkBalance(ctx); err != nil {
+		logger.Error(err)
+		return -1, err
+	}
+	output, err := sendWithOptionsContext(ctx, c.sender, phone, text, opts)
+	if err != nil {
+		logger.Error(err)
+		return -1, err
+	}
+	if err = output.Err(); err != nil {
+		logger.Error(err)
+		return -1, err
 	}
 
+	if beforeTrack != nil {
+		beforeTrack(output.Id, output.Gateway)
+	}
 	if track {
 		st := NewUnknownMessageStatus(output.Id, phone)
+		st.Options = opts
+		st.Parts = int32(parts)
+		st.Gateway = output.Gateway
 		err = c.storage.Put(st)
 		if err != nil {
 			return -1, logger.Error(err)
@@ -85,6 +250,145 @@ func (c *SenderCheckerImpl) Send(phone string, text string, track bool) (int64,
 	return output.Id, nil
 }
 
+// checkParts returns the number of parts of the text or ErrTooManyParts if MaxParts is set and exceeded.
+func (c *SenderCheckerImpl) checkParts(text string) (int, error) {
+	parts := segment.Analyze(text).PartCount()
+	if c.opts.MaxParts > 0 && parts > c.opts.MaxParts {
+		return parts, fmt.Errorf("%w: %d parts, max is %d", ErrTooManyParts, parts, c.opts.MaxParts)
+	}
+	return parts, nil
+}
+
+// checkBalance returns ErrBalanceTooLow if MinBalance is set and the last known balance is below it.
+// A failed balance request doesn't prevent sending, the gateway refuses the message itself if funds are insufficient.
+// Failures are remembered for the BalanceCheckInterval as well, so a broken balance request doesn't slow down
+// every send. Concurrent sends share a single balance request.
+func (c *SenderCheckerImpl) checkBalance(ctx context.Context) error {
+	if c.opts.MinBalance == 0 {
+		return nil
+	}
+	interval := c.opts.BalanceCheckInterval
+	if interval == 0 {
+		interval = DefaultBalanceCheckInterval
+	}
+
+	c.balanceM.Lock()
+	if c.balanceFetch == nil && time.Since(c.balanceAt) > interval {
+		c.balanceFetch = make(chan struct{})
+		go c.fetchBalance(c.balanceFetch)
+	}
+	fetch := c.balanceFetch
+	c.balanceM.Unlock()
+
+	if fetch != nil {
+		select {
+		case <-fetch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	c.balanceM.Lock()
+	defer c.balanceM.Unlock()
+	if c.balanceErr == nil && float64(c.balance) < c.opts.MinBalance {
+		return ErrBalanceTooLow
+	}
+	return nil
+}
+
+// fetchBalance requests the balance without holding the lock and closes done when it is over. The request isn't
+// bound to the context of the send which started it, because its result is shared by the other sends.
+func (c *SenderCheckerImpl) fetchBalance(done chan struct{}) {
+	output, err := c.BalanceContext(context.Background())
+	if err != nil {
+		logger.Warnf("Cannot check balance: '%s'", err)
+	}
+
+	c.balanceM.Lock()
+	defer c.balanceM.Unlock()
+	c.balanceErr, c.balanceAt = err, time.Now()
+	if err == nil {
+		c.balance = output.Balance
+	}
+	c.balanceFetch = nil
+	close(done)
+}
+
+// Balance returns the account balance. Returns ErrNotSupported if the sender doesn't implement AccountFetcher.
+func (c *SenderCheckerImpl) Balance() (*BalanceResponse, error) {
+	return c.BalanceContext(context.Background())
+}
+
+func (c *SenderCheckerImpl) BalanceContext(ctx context.Context) (*BalanceResponse, error) {
+	f, err := accountFetcher(c.sender)
+	if err != nil {
+		return nil, err
+	}
+	output, err := f.BalanceContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = output.Err(); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// EstimateCost returns the cost of the message without sending it. Returns ErrNotSupported if the sender
+// doesn't implement AccountFetcher.
+func (c *SenderCheckerImpl) EstimateCost(phone string, text string) (*CostResponse, error) {
+	return c.EstimateCostContext(context.Background(), phone, text)
+}
+
+func (c *SenderCheckerImpl) EstimateCostContext(ctx context.Context, phone string, text string) (*CostResponse, error) {
+	f, err := accountFetcher(c.sender)
+	if err != nil {
+		return nil, err
+	}
+	output, err := f.EstimateCostContext(ctx, phone, text)
+	if err != nil {
+		return nil, err
+	}
+	if err = output.Err(); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
 func (c *SenderCheckerImpl) GetActualStatus(id int64) (*MessageStatus, error) {
+	return c.GetActualStatusContext(context.Background(), id)
+}
+
+func (c *SenderCheckerImpl) GetActualStatusContext(ctx context.Context, id int64) (*MessageStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return c.storage.Get(id)
 }
+
+// Stop stops tracking and waits for the check in progress to finish, so the storage can be closed afterwards.
+// A stopped checker cannot be used anymore.
+func (c *SenderCheckerImpl) Stop() error {
+	if err := c.tracker.Stop(); err != nil {
+		return err
+	}
+	<-c.tracker.done
+	return nil
+}
+
+// Subscribe registers a listener for status changes of the tracked messages. See MessageTracker.Subscribe.
+func (c *SenderCheckerImpl) Subscribe(listener StatusListener) (unsubscribe func()) {
+	return c.tracker.Subscribe(listener)
+}
+
+// StatusCallbackHandler creates a handler of the SMSC status callbacks which writes statuses to the storage
+// of the checker and notifies its subscribers. See StatusCallbackHandler.
+func (c *SenderCheckerImpl) StatusCallbackHandler(secret string) (*StatusCallbackHandler, error) {
+	return newStatusCallbackHandler(c.storage, "", secret, c.tracker)
+}
+
+// GatewayStatusCallbackHandler is the same as StatusCallbackHandler for the messages sent through the gateway
+// of a MultiGatewayProvider.
+func (c *SenderCheckerImpl) GatewayStatusCallbackHandler(gateway string, secret string) (*StatusCallbackHandler, error) {
+	return newStatusCallbackHandler(c.storage, gateway, secret, c.tracker)
+}
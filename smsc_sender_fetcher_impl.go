@@ -1,13 +1,17 @@
 package gosmsc
 
 import (
+	"context"
 	. "github.com/goodsign/gosmsc/contract"
+	phonenum "github.com/goodsign/gosmsc/phone"
 )
 
 // SenderFetcherImpl is a plain implementation of Sender and StatusFetcher interfaces that
 // interacts with SMSC web gateway.
 // Unlike SenderCheckerImpl, SenderFetcherImpl doesn't track or store anything, it is just
 // a gateway caller without any side-effects.
+// If the gateway returns an error in the response, both the response and the SmscError are returned.
+// Phones of the sent messages are normalized, invalid ones are rejected without calling the gateway.
 type SenderFetcherImpl struct {
 	sender        Sender
 	statusFetcher StatusFetcher
@@ -39,9 +43,94 @@ func NewSenderFetcherImpl(opts *SmscClientOptions) (*SenderFetcherImpl, error) {
 }
 
 func (c *SenderFetcherImpl) Send(phone string, text string) (*SendSMSResponse, error) {
-	return c.sender.Send(phone, text)
+	return c.SendContext(context.Background(), phone, text)
+}
+
+func (c *SenderFetcherImpl) SendContext(ctx context.Context, phone string, text string) (*SendSMSResponse, error) {
+	return c.SendWithOptionsContext(ctx, phone, text, nil)
+}
+
+// SendWithOptions is the same as Send, but also accepts optional send parameters. Returns ErrNotSupported
+// if opts are set and the sender doesn't implement SenderWithOptions.
+func (c *SenderFetcherImpl) SendWithOptions(phone string, text string, opts *SendOptions) (*SendSMSResponse, error) {
+	return c.SendWithOptionsContext(context.Background(), phone, text, opts)
+}
+
+func (c *SenderFetcherImpl) SendWithOptionsContext(ctx context.Context, phone string, text string, opts *SendOptions) (*SendSMSResponse, error) {
+	phone, err := phonenum.Normalize(phone)
+	if err != nil {
+		return nil, ErrInvalidPhoneFormat.Wrap(err)
+	}
+	output, err := sendWithOptionsContext(ctx, c.sender, phone, text, opts)
+	if err != nil {
+		return nil, err
+	}
+	return output, output.Err()
+}
+
+// Balance returns the account balance. Returns ErrNotSupported if the sender doesn't implement AccountFetcher.
+func (c *SenderFetcherImpl) Balance() (*BalanceResponse, error) {
+	return c.BalanceContext(context.Background())
+}
+
+func (c *SenderFetcherImpl) BalanceContext(ctx context.Context) (*BalanceResponse, error) {
+	f, err := accountFetcher(c.sender)
+	if err != nil {
+		return nil, err
+	}
+	output, err := f.BalanceContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return output, output.Err()
+}
+
+// EstimateCost returns the cost of the message without sending it. Returns ErrNotSupported if the sender
+// doesn't implement AccountFetcher.
+func (c *SenderFetcherImpl) EstimateCost(phone string, text string) (*CostResponse, error) {
+	return c.EstimateCostContext(context.Background(), phone, text)
+}
+
+func (c *SenderFetcherImpl) EstimateCostContext(ctx context.Context, phone string, text string) (*CostResponse, error) {
+	f, err := accountFetcher(c.sender)
+	if err != nil {
+		return nil, err
+	}
+	output, err := f.EstimateCostContext(ctx, phone, text)
+	if err != nil {
+		return nil, err
+	}
+	return output, output.Err()
 }
 
 func (c *SenderFetcherImpl) FetchStatus(id int64, phone string) (*CheckStatusResponse, error) {
-	return c.statusFetcher.FetchStatus(id, phone)
+	return c.FetchStatusContext(context.Background(), id, phone)
+}
+
+func (c *SenderFetcherImpl) FetchStatusContext(ctx context.Context, id int64, phone string) (*CheckStatusResponse, error) {
+	output, err := fetchStatusContext(ctx, c.statusFetcher, id, phone)
+	if err != nil {
+		return nil, err
+	}
+	return output, output.Err()
+}
+
+// FetchStatusBatch fetches statuses in one call if the underlying status fetcher supports batches,
+// or one by one otherwise. Unlike FetchStatus, gateway errors of single messages are not returned,
+// they are available in the corresponding responses.
+func (c *SenderFetcherImpl) FetchStatusBatch(ctx context.Context, requests []StatusRequest) ([]CheckStatusResponse, error) {
+	if f, ok := c.statusFetcher.(BatchStatusFetcher); ok {
+		return f.FetchStatusBatch(ctx, requests)
+	}
+
+	outputs := make([]CheckStatusResponse, 0, len(requests))
+	for _, r := range requests {
+		output, err := fetchStatusContext(ctx, c.statusFetcher, r.Id, r.Phone)
+		if err != nil {
+			return nil, err
+		}
+		output.Id, output.Phone = r.Id, r.Phone
+		outputs = append(outputs, *output)
+	}
+	return outputs, nil
 }
@@ -1,7 +1,11 @@
 package gosmsc
 
 import (
+	"context"
+	"errors"
 	. "github.com/goodsign/gosmsc/contract"
+	"github.com/goodsign/gosmsc/phone"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,6 +30,9 @@ func TestInvalidPasswordSend(t *testing.T) {
 	if err == nil {
 		t.Fatal(err)
 	}
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected to get '%s'. Got: '%s'.", ErrInvalidCredentials, err)
+	}
 }
 
 func TestSuccessfulSend(t *testing.T) {
@@ -108,3 +115,249 @@ func TestStoppingTracking(t *testing.T) {
 		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusCodeUnknown, mstatus.StatusCode)
 	}
 }
+
+func TestCancelledSend(t *testing.T) {
+	impl, err := newTestSenderCheckerImpl(&smscTestClientOptions{false, false, 0}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = impl.SendContext(ctx, "+7 921 123 45 67", "test", false)
+	if err != context.Canceled {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", context.Canceled, err)
+	}
+}
+
+func TestFailedMessageIsNotPending(t *testing.T) {
+	impl, err := newTestSenderCheckerImpl(&smscTestClientOptions{false, false, MessageStatusImpossibleToDeliver}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := impl.Send("+7 921 123 45 67", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mstatus.StatusCode.IsFinal() || !mstatus.StatusCode.IsFailed() || mstatus.StatusCode.IsDelivered() {
+		t.Fatalf("Expected '%s' to be a final failed status", mstatus.StatusCode)
+	}
+	pending, err := impl.storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending messages. Got '%d'", len(pending))
+	}
+}
+
+func TestAbandoningOldMessages(t *testing.T) {
+	opts := &SenderCheckerOptions{Tracker: TrackerOptions{MaxTrackingAge: time.Hour}}
+	impl, err := newTestSenderCheckerImplWithOptions(&smscTestClientOptions{false, false, MessageStatusTransferred}, time.Hour, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := NewUnknownMessageStatus(getNextMessageId(), "+7 921 123 45 67")
+	old.CreatedAt = time.Now().Add(-2 * time.Hour)
+	if err = impl.storage.Put(old); err != nil {
+		t.Fatal(err)
+	}
+	id, err := impl.Send("+7 921 123 45 67", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+
+	mstatus, err := impl.GetActualStatus(old.MessageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusAbandoned {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusAbandoned, mstatus.StatusCode)
+	}
+	mstatus, err = impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusTransferred {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusTransferred, mstatus.StatusCode)
+	}
+	pending, err := impl.storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].MessageId != id {
+		t.Fatalf("Expected only message '%d' to be pending. Got '%v'", id, pending)
+	}
+}
+
+func TestSenderFetcherTypedErrors(t *testing.T) {
+	sint := &smsTestClientInternal{&smscTestClientOptions{true, false, 0}}
+	impl, err := newSenderFetcherImplInternal(sint, sint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := impl.Send("+7 921 123 45 67", "test")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrInvalidCredentials, err)
+	}
+	if output == nil || output.ErrorCode != ErrInvalidCredentials.Code {
+		t.Fatalf("Expected response with error code. Got: '%v'.", output)
+	}
+	_, err = impl.FetchStatus(1, "+7 921 123 45 67")
+	var smscErr *SmscError
+	if !errors.As(err, &smscErr) || smscErr.Code != ErrInvalidCredentials.Code {
+		t.Fatalf("Expected to get SmscError. Got: '%v'.", err)
+	}
+	if errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("Expected '%s' not to match '%s'", err, ErrInsufficientFunds)
+	}
+}
+
+func TestBatchStatusChecks(t *testing.T) {
+	expectedCode := MessageStatusCode(555)
+	opts := &SenderCheckerOptions{Tracker: TrackerOptions{BatchSize: 2}}
+	impl, sint, err := newTestBatchSenderCheckerImpl(&smscTestClientOptions{false, false, expectedCode}, time.Hour, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		id, err := impl.Send("+7 921 123 45 67", "test", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+
+	sint.m.Lock()
+	sizes := sint.batchSizes[:3]
+	sint.m.Unlock()
+	if sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Fatalf("Expected batches of sizes 2, 2, 1. Got '%v'", sizes)
+	}
+	for _, id := range ids {
+		mstatus, err := impl.GetActualStatus(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mstatus.StatusCode != expectedCode {
+			t.Fatalf("Expected code = '%d'. Got '%d'", expectedCode, mstatus.StatusCode)
+		}
+	}
+}
+
+func TestInvalidPhoneSend(t *testing.T) {
+	g := newFakeGateway(`{"id":1,"cnt":1}`)
+	defer g.Close()
+
+	storage := newMessageStatusTestStorage()
+	impl, err := NewSenderCheckerImpl(&SmscClientOptions{User: "user", Password: "pwd", BaseUrl: g.URL}, storage, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	// The error is the same as in bulk results.
+	_, err = impl.Send("+7 921 123", "test", true)
+	if !errors.Is(err, phone.ErrInvalidPhone) || !errors.Is(err, ErrInvalidPhoneFormat) {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrInvalidPhoneFormat, err)
+	}
+	if g.lastRequest() != nil {
+		t.Fatal("Gateway was called for an invalid phone")
+	}
+
+	id, err := impl.Send("8 (921) 123-45-67", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phones := g.lastRequest().PostForm.Get("phones"); phones != "+79211234567" {
+		t.Fatalf("Expected phones = '+79211234567'. Got '%s'", phones)
+	}
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.Phone != "+79211234567" {
+		t.Fatalf("Expected stored phone = '+79211234567'. Got '%s'", mstatus.Phone)
+	}
+}
+
+func TestMaxParts(t *testing.T) {
+	impl, err := newTestSenderCheckerImplWithOptions(&smscTestClientOptions{false, false, MessageStatusWaiting}, time.Hour,
+		&SenderCheckerOptions{MaxParts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = impl.Send("+7 921 123 45 67", strings.Repeat("я", 135), true); !errors.Is(err, ErrTooManyParts) {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrTooManyParts, err)
+	}
+	id, err := impl.Send("+7 921 123 45 67", strings.Repeat("я", 134), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.Parts != 2 {
+		t.Fatalf("Expected parts = '2'. Got '%d'", mstatus.Parts)
+	}
+
+	results, err := impl.SendBulk([]BulkMessage{{Phone: "+7 921 123 45 67", Text: strings.Repeat("я", 135)}}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results[0].Error, ErrTooManyParts) || !errors.Is(results[0].Error, ErrInvalidParameters) {
+		t.Fatalf("Expected to get '%s'. Got: '%v'.", ErrTooManyParts, results[0].Error)
+	}
+}
+
+func TestSendHookBeforeTracking(t *testing.T) {
+	impl, err := newTestSenderCheckerImpl(&smscTestClientOptions{false, false, MessageStatusWaiting}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.tracker.Stop()
+
+	var hookId int64
+	var hookErr error
+	id, err := impl.SendWithHookContext(context.Background(), "+7 921 123 45 67", "test", true, nil, func(id int64, gateway string) {
+		hookId = id
+		// The message is not tracked yet, so no status events can be published.
+		_, hookErr = impl.GetActualStatus(id)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hookId != id || hookErr != MessageNotFound {
+		t.Fatalf("Expected hook to be called with id %d before tracking. Got '%d', '%v'", id, hookId, hookErr)
+	}
+	if _, err = impl.GetActualStatus(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSenderCheckerStop(t *testing.T) {
+	impl, err := newTestSenderCheckerImpl(&smscTestClientOptions{false, false, MessageStatusWaiting}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = impl.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if !impl.tracker.IsStopped() {
+		t.Fatal("Expected tracker to be stopped")
+	}
+	if err = impl.Stop(); err == nil {
+		t.Fatal("Expected the second Stop to fail")
+	}
+}
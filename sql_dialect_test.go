@@ -0,0 +1,55 @@
+package gosmsc
+
+import (
+	. "github.com/goodsign/gosmsc/contract"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests don't need a database driver, see sql_status_storage_test.go for the storage tests.
+
+func TestSqlRebind(t *testing.T) {
+	query := `SELECT a FROM t WHERE b = ? AND c = ?`
+	ms := &MessageStatusSqlStorage{dialect: SqlDialectPostgres}
+	if q := ms.rebind(query); q != `SELECT a FROM t WHERE b = $1 AND c = $2` {
+		t.Fatalf("Unexpected postgres query: '%s'", q)
+	}
+	ms.dialect = SqlDialectSqlite
+	if q := ms.rebind(query); q != query {
+		t.Fatalf("Unexpected sqlite query: '%s'", q)
+	}
+}
+
+func TestSqlTime(t *testing.T) {
+	ms := &MessageStatusSqlStorage{dialect: SqlDialectSqlite}
+	expected := time.Date(2014, 3, 5, 10, 20, 30, 123456789, time.UTC)
+	for _, value := range []interface{}{ms.timeValue(expected), []byte(ms.timeValue(expected).(string)), expected} {
+		var st sqlTime
+		if err := st.Scan(value); err != nil {
+			t.Fatal(err)
+		}
+		if !st.t.Equal(expected) {
+			t.Fatalf("Expected time = '%v'. Got '%v'", expected, st.t)
+		}
+	}
+	var st sqlTime
+	if err := st.Scan(int64(1)); err == nil {
+		t.Fatal("Expected to get error. Got: nil.")
+	}
+}
+
+func TestSqlPendingCondition(t *testing.T) {
+	list := pendingCondition[strings.Index(pendingCondition, "(")+1 : strings.LastIndex(pendingCondition, ")")]
+	codes := strings.Split(list, ", ")
+	final := FinalMessageStatusCodes()
+	if len(codes) != len(final) {
+		t.Fatalf("Expected %d final codes. Got '%s'", len(final), list)
+	}
+	for i, code := range final {
+		if codes[i] != strconv.Itoa(int(code)) {
+			t.Fatalf("Expected code = '%d'. Got '%s'", code, codes[i])
+		}
+	}
+}
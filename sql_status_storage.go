@@ -0,0 +1,281 @@
+package gosmsc
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SqlDialect is the SQL database kind used by MessageStatusSqlStorage.
+type SqlDialect string
+
+const (
+	SqlDialectPostgres SqlDialect = "postgres" // PostgreSQL 9.5 or later, e.g. with the github.com/lib/pq driver
+	SqlDialectSqlite   SqlDialect = "sqlite"   // SQLite 3.24 or later, e.g. with the pure-Go modernc.org/sqlite driver
+)
+
+const (
+	messagesTable   = "messages"
+	migrationsTable = "gosmsc_migrations"
+
+	// Sqlite stores times as text in this layout, so that they are ordered as strings.
+	sqliteTimeLayout = "2006-01-02T15:04:05.000000000Z"
+)
+
+// sqlMigrations are applied in order, each one once. Schema changes are added as new migrations, the existing ones
+// must not be modified, so they are written as literal SQL instead of being built from the code that may change.
+// {timestamp} is replaced by the dialect timestamp column type.
+var sqlMigrations = [][]string{
+	{
+		// Message ids are unique per gateway only, so the gateway is a part of the primary key.
+		`CREATE TABLE messages (
+			messageid BIGINT NOT NULL,
+			phone TEXT NOT NULL,
+			createdat {timestamp} NOT NULL,
+			statusupdatedat {timestamp} NOT NULL,
+			statuscode INTEGER NOT NULL,
+			operator TEXT NOT NULL,
+			region TEXT NOT NULL,
+			statuserrorcode INTEGER NOT NULL,
+			callbackat {timestamp} NOT NULL,
+			options TEXT,
+			parts INTEGER NOT NULL,
+			gateway TEXT NOT NULL,
+			PRIMARY KEY (messageid, phone, gateway)
+		)`,
+		// Pending messages are a small part of the table, so they are indexed separately in the creation order.
+		// The planner uses a partial index only if the query condition implies its predicate, so the predicate
+		// is pendingCondition.
+		`CREATE INDEX messages_pending ON messages (createdat)
+			WHERE statuserrorcode = 0 AND statuscode NOT IN (-998, -3, 1, 2, 3, 4, 20, 22, 23, 24, 25)`,
+	},
+}
+
+// pendingCondition selects the messages for which MessageStatus.IsPending is true. Final codes are inlined instead
+// of passed as arguments, so that the planner can match the condition against the pending index predicate.
+// A change of FinalMessageStatusCodes requires changing it along with a new migration recreating the index.
+const pendingCondition = `statuserrorcode = 0 AND statuscode NOT IN (-998, -3, 1, 2, 3, 4, 20, 22, 23, 24, 25)`
+
+const messageColumns = `messageid, phone, createdat, statusupdatedat, statuscode, operator, region, statuserrorcode, ` +
+	`callbackat, options, parts, gateway`
+
+// MessageStatusSqlStorage is a database/sql implementation of the StatusContainer. The database driver is
+// registered by the application. The schema is created and migrated by the constructor.
+type MessageStatusSqlStorage struct {
+	db      *sql.DB
+	dialect SqlDialect
+}
+
+func NewMessageStatusSqlStorage(db *sql.DB, dialect SqlDialect) (*MessageStatusSqlStorage, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db is nil")
+	}
+	if dialect != SqlDialectPostgres && dialect != SqlDialectSqlite {
+		return nil, fmt.Errorf("Unknown sql dialect '%s'", dialect)
+	}
+	ms := &MessageStatusSqlStorage{db, dialect}
+	if err := ms.migrate(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// migrate applies the migrations which were not applied yet. Every migration is applied in a transaction.
+func (ms *MessageStatusSqlStorage) migrate() error {
+	_, err := ms.db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return logger.Error(err)
+	}
+	var version int
+	err = ms.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ` + migrationsTable).Scan(&version)
+	if err != nil {
+		return logger.Error(err)
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		logger.Infof("Applying sql storage migration %d", version+1)
+		tx, err := ms.db.Begin()
+		if err != nil {
+			return logger.Error(err)
+		}
+		for _, statement := range sqlMigrations[version] {
+			if _, err = tx.Exec(strings.Replace(statement, "{timestamp}", ms.timestampType(), -1)); err != nil {
+				tx.Rollback()
+				return logger.Errorf("Migration %d failed: '%s'", version+1, err)
+			}
+		}
+		if _, err = tx.Exec(ms.rebind(`INSERT INTO `+migrationsTable+` (version) VALUES (?)`), version+1); err != nil {
+			tx.Rollback()
+			return logger.Error(err)
+		}
+		if err = tx.Commit(); err != nil {
+			return logger.Error(err)
+		}
+	}
+	return nil
+}
+
+// Get returns the first created recipient of the message.
+func (ms *MessageStatusSqlStorage) Get(messageId int64) (*MessageStatus, error) {
+	logger.Tracef("messageId: '%d'", messageId)
+
+	row := ms.db.QueryRow(ms.rebind(`SELECT `+messageColumns+` FROM `+messagesTable+
+		` WHERE messageid = ? ORDER BY createdat, phone, gateway LIMIT 1`), messageId)
+	return ms.scanOne(row)
+}
+
+// GetRecipient returns the status of a message sent to several recipients or through several gateways for one of them.
+func (ms *MessageStatusSqlStorage) GetRecipient(messageId int64, phone string, gateway string) (*MessageStatus, error) {
+	logger.Tracef("messageId: '%d', phone: '%s', gateway: '%s'", messageId, phone, gateway)
+
+	row := ms.db.QueryRow(ms.rebind(`SELECT `+messageColumns+` FROM `+messagesTable+
+		` WHERE messageid = ? AND phone = ? AND gateway = ?`), messageId, phone, gateway)
+	return ms.scanOne(row)
+}
+
+func (ms *MessageStatusSqlStorage) Put(message *MessageStatus) error {
+	if message == nil {
+		return logger.Errorf("message is nil")
+	}
+	logger.Tracef("message id: '%d'", message.MessageId)
+
+	var options interface{}
+	if message.Options != nil {
+		data, err := json.Marshal(message.Options)
+		if err != nil {
+			return logger.Error(err)
+		}
+		options = string(data)
+	}
+	_, err := ms.db.Exec(ms.rebind(`INSERT INTO `+messagesTable+` (`+messageColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (messageid, phone, gateway) DO UPDATE SET
+			createdat = excluded.createdat,
+			statusupdatedat = excluded.statusupdatedat,
+			statuscode = excluded.statuscode,
+			operator = excluded.operator,
+			region = excluded.region,
+			statuserrorcode = excluded.statuserrorcode,
+			callbackat = excluded.callbackat,
+			options = excluded.options,
+			parts = excluded.parts`),
+		message.MessageId, message.Phone, ms.timeValue(message.CreatedAt), ms.timeValue(message.StatusUpdatedAt),
+		int32(message.StatusCode), message.Operator, message.Region, message.StatusErrorCode,
+		ms.timeValue(message.CallbackAt), options, message.Parts, message.Gateway)
+	if err != nil {
+		return logger.Error(err)
+	}
+	return nil
+}
+
+// GetPending returns messages for which MessageStatus.IsPending is true. The query must be kept in sync with it.
+func (ms *MessageStatusSqlStorage) GetPending() ([]MessageStatus, error) {
+	logger.Trace("")
+
+	rows, err := ms.db.Query(`SELECT ` + messageColumns + ` FROM ` + messagesTable + ` WHERE ` + pendingCondition +
+		` ORDER BY createdat, messageid, phone`)
+	if err != nil {
+		return nil, logger.Error(err)
+	}
+	defer rows.Close()
+
+	var messages []MessageStatus
+	for rows.Next() {
+		message, err := ms.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, logger.Error(err)
+	}
+	return messages, nil
+}
+
+func (ms *MessageStatusSqlStorage) scanOne(row *sql.Row) (*MessageStatus, error) {
+	message, err := ms.scan(row)
+	if err == sql.ErrNoRows {
+		return nil, MessageNotFound
+	}
+	return message, err
+}
+
+func (ms *MessageStatusSqlStorage) scan(row interface{ Scan(...interface{}) error }) (*MessageStatus, error) {
+	message := new(MessageStatus)
+	var createdAt, statusUpdatedAt, callbackAt sqlTime
+	var options sql.NullString
+
+	err := row.Scan(&message.MessageId, &message.Phone, &createdAt, &statusUpdatedAt, &message.StatusCode,
+		&message.Operator, &message.Region, &message.StatusErrorCode, &callbackAt, &options, &message.Parts,
+		&message.Gateway)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, logger.Error(err)
+	}
+	message.CreatedAt, message.StatusUpdatedAt, message.CallbackAt = createdAt.t, statusUpdatedAt.t, callbackAt.t
+	if options.Valid {
+		message.Options = new(SendOptions)
+		if err = json.Unmarshal([]byte(options.String), message.Options); err != nil {
+			return nil, logger.Error(err)
+		}
+	}
+	return message, nil
+}
+
+// rebind replaces '?' placeholders by the dialect ones.
+func (ms *MessageStatusSqlStorage) rebind(query string) string {
+	if ms.dialect != SqlDialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (ms *MessageStatusSqlStorage) timestampType() string {
+	if ms.dialect == SqlDialectPostgres {
+		return "TIMESTAMPTZ"
+	}
+	return "TEXT"
+}
+
+func (ms *MessageStatusSqlStorage) timeValue(t time.Time) interface{} {
+	if ms.dialect == SqlDialectPostgres {
+		return t
+	}
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// sqlTime scans times stored by timeValue.
+type sqlTime struct {
+	t time.Time
+}
+
+func (st *sqlTime) Scan(value interface{}) (err error) {
+	switch v := value.(type) {
+	case time.Time:
+		st.t = v
+	case string:
+		st.t, err = time.Parse(sqliteTimeLayout, v)
+	case []byte:
+		st.t, err = time.Parse(sqliteTimeLayout, string(v))
+	default:
+		err = fmt.Errorf("Cannot scan '%T' as time", value)
+	}
+	return
+}
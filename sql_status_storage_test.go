@@ -0,0 +1,134 @@
+package gosmsc
+
+import (
+	"database/sql"
+	. "github.com/goodsign/gosmsc/contract"
+	_ "modernc.org/sqlite"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSqlStorage(t *testing.T) (*MessageStatusSqlStorage, *sql.DB) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection opens a new in-memory database.
+	db.SetMaxOpenConns(1)
+	storage, err := NewMessageStatusSqlStorage(db, SqlDialectSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, db
+}
+
+func TestSqlStorage(t *testing.T) {
+	storage, db := newTestSqlStorage(t)
+	defer db.Close()
+
+	if _, err := storage.Get(1); err != MessageNotFound {
+		t.Fatalf("Expected MessageNotFound. Got '%v'", err)
+	}
+
+	message := NewUnknownMessageStatus(1, "79000000001")
+	message.Options = &SendOptions{Sender: "sender", Valid: time.Hour}
+	message.Parts = 2
+	if err := storage.Put(message); err != nil {
+		t.Fatal(err)
+	}
+	second := NewUnknownMessageStatus(1, "79000000002")
+	second.CreatedAt = message.CreatedAt.Add(time.Second)
+	storage.Put(second)
+
+	got, err := storage.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Phone != message.Phone || !got.CreatedAt.Equal(message.CreatedAt) || got.Parts != 2 ||
+		got.Options == nil || got.Options.Valid != time.Hour || !got.CallbackAt.IsZero() {
+		t.Fatalf("Stored message differs. Expected '%v'. Got '%v'", message, got)
+	}
+
+	second.StatusCode = MessageStatusComplete
+	second.Operator = "operator"
+	if err = storage.Put(second); err != nil {
+		t.Fatal(err)
+	}
+	got, err = storage.GetRecipient(1, second.Phone, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.StatusCode != MessageStatusComplete || got.Operator != "operator" || got.Options != nil {
+		t.Fatalf("Message was not updated. Got '%v'", got)
+	}
+
+	failed := NewUnknownMessageStatus(2, "79000000001")
+	failed.StatusErrorCode = 1
+	storage.Put(failed)
+	storage.Put(NewUnknownMessageStatus(3, "79000000001"))
+
+	pending, err := storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].MessageId != 1 || pending[1].MessageId != 3 {
+		t.Fatalf("Expected messages 1 and 3 to be pending. Got '%v'", pending)
+	}
+
+	// Migrations are applied once.
+	if _, err = NewMessageStatusSqlStorage(db, SqlDialectSqlite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewMessageStatusSqlStorage(db, "mysql"); err == nil {
+		t.Fatalf("Expected unknown dialect error")
+	}
+}
+
+func TestSqlPendingIndex(t *testing.T) {
+	storage, db := newTestSqlStorage(t)
+	defer db.Close()
+
+	rows, err := storage.db.Query(`EXPLAIN QUERY PLAN SELECT ` + messageColumns + ` FROM ` + messagesTable +
+		` WHERE ` + pendingCondition + ` ORDER BY createdat, messageid, phone`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err = rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if !strings.Contains(strings.Join(plan, "\n"), messagesTable+"_pending") {
+		t.Fatalf("Expected the pending index to be used. Got plan '%v'", plan)
+	}
+}
+
+func TestSqlStorageTracking(t *testing.T) {
+	storage, db := newTestSqlStorage(t)
+	defer db.Close()
+
+	putPendingMessages(t, storage, 3)
+	sint := &smsTestClientInternal{&smscTestClientOptions{expectedStatusCode: MessageStatusComplete}}
+	tracker, err := StartTracking(storage, sint, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Stop()
+
+	tracker.tickerForTest <- false
+	tracker.tickerForTest <- false
+
+	pending, err := storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending messages. Got '%d'", len(pending))
+	}
+}
@@ -0,0 +1,172 @@
+package gosmsc
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	. "github.com/goodsign/gosmsc/contract"
+	phonenum "github.com/goodsign/gosmsc/phone"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusCallbackHandler receives message statuses pushed by SMSC to the status callback url configured
+// in the account settings, and writes them to the storage. The tracker polls messages that receive
+// callbacks rarely (see TrackerOptions.CallbackPollInterval).
+//
+// Callbacks are verified by the 'md5' parameter, which SMSC calculates as md5 of 'id:phone:status:secret'
+// string, where the secret is the account password. Callbacks of the messages that are not in the storage
+// (e.g. sent without tracking) are acknowledged and ignored.
+//
+// Message ids are unique per gateway only, so every gateway sending callbacks needs its own handler.
+type StatusCallbackHandler struct {
+	storage StatusContainer
+	gateway string // MessageStatus.Gateway of the messages which statuses are received
+	secret  string
+	tracker *MessageTracker // Publishes status change events. Can be nil.
+}
+
+// NewStatusCallbackHandler creates a handler of the messages sent without a MultiGatewayProvider.
+func NewStatusCallbackHandler(storage StatusContainer, secret string) (*StatusCallbackHandler, error) {
+	return newStatusCallbackHandler(storage, "", secret, nil)
+}
+
+// NewGatewayStatusCallbackHandler creates a handler of the messages sent through the gateway of a MultiGatewayProvider.
+func NewGatewayStatusCallbackHandler(storage StatusContainer, gateway string, secret string) (*StatusCallbackHandler, error) {
+	return newStatusCallbackHandler(storage, gateway, secret, nil)
+}
+
+func newStatusCallbackHandler(storage StatusContainer, gateway string, secret string,
+	tracker *MessageTracker) (*StatusCallbackHandler, error) {
+	if storage == nil {
+		return nil, logger.Error("storage cannot be nil")
+	}
+	if len(secret) == 0 {
+		return nil, logger.Error("secret cannot be empty")
+	}
+	return &StatusCallbackHandler{storage, gateway, secret, tracker}, nil
+}
+
+func (h *StatusCallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	phone := r.Form.Get("phone")
+	status := r.Form.Get("status")
+	code, err := strconv.ParseInt(status, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if !strings.EqualFold(r.Form.Get("md5"), CallbackSignature(h.secret, id, phone, status)) {
+		logger.Warnf("Status callback of message %v has invalid signature", id)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	// Error code and timestamp are optional.
+	errorCode, _ := strconv.ParseInt(r.Form.Get("err"), 10, 32)
+	updatedAt := time.Now()
+	if ts, err := strconv.ParseInt(r.Form.Get("ts"), 10, 64); err == nil && ts > 0 {
+		updatedAt = time.Unix(ts, 0)
+	}
+
+	// Phones are stored normalized, the gateway may send them in another format.
+	if normalized, err := phonenum.Normalize(phone); err == nil {
+		phone = normalized
+	}
+	err = h.update(id, phone, MessageStatusCode(code), int32(errorCode), updatedAt)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func (h *StatusCallbackHandler) update(id int64, phone string, code MessageStatusCode, errorCode int32, updatedAt time.Time) error {
+	logger.Debugf("Status callback of message %v: '%s'", id, code)
+	message, err := getRecipient(h.storage, id, phone, h.gateway)
+	if err == MessageNotFound {
+		logger.Debugf("Message %v is not tracked, callback ignored", id)
+		return nil
+	}
+	if err != nil {
+		return logger.Error(err)
+	}
+	// Callbacks may come late or out of order. Callback timestamps have second precision.
+	if message.StatusCode.IsFinal() || updatedAt.Before(message.StatusUpdatedAt.Truncate(time.Second)) {
+		logger.Debugf("Status callback of message %v is older than the stored status '%s', callback ignored", id,
+			message.StatusCode)
+		return nil
+	}
+
+	old := *message
+	message.StatusCode = code
+	message.StatusErrorCode = errorCode
+	message.StatusUpdatedAt = updatedAt
+	message.CallbackAt = time.Now()
+	err = h.storage.Put(message)
+	if err != nil {
+		return logger.Error(err)
+	}
+	if h.tracker != nil {
+		h.tracker.publishChange(&old, message)
+	}
+	return nil
+}
+
+// CallbackSignature returns the md5 signature of a status callback.
+func CallbackSignature(secret string, id int64, phone string, status string) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d:%s:%s:%s", id, phone, status, secret)))
+	return hex.EncodeToString(sum[:])
+}
+
+// getRecipient returns the stored message sent to the phone through the gateway. Storages which are not
+// RecipientStatusContainers return any recipient of the message, which is accepted if its gateway matches.
+//
+// Messages stored before phones were normalized keep the phone in the format it was sent with, so if there is
+// no exact match, the first recipient of the message is returned if its phone normalizes to the same number.
+func getRecipient(storage StatusContainer, id int64, phone string, gateway string) (*MessageStatus, error) {
+	rs, ok := storage.(RecipientStatusContainer)
+	if !ok {
+		message, err := storage.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if message.Gateway != gateway {
+			return nil, MessageNotFound
+		}
+		return message, nil
+	}
+	message, err := rs.GetRecipient(id, phone, gateway)
+	if err != MessageNotFound {
+		return message, err
+	}
+	message, err = storage.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if message.Gateway != gateway || !samePhone(message.Phone, phone) {
+		return nil, MessageNotFound
+	}
+	return message, nil
+}
+
+func samePhone(a string, b string) bool {
+	na, err := phonenum.Normalize(a)
+	if err != nil {
+		return false
+	}
+	nb, err := phonenum.Normalize(b)
+	return err == nil && na == nb
+}
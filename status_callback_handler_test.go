@@ -0,0 +1,287 @@
+package gosmsc
+
+import (
+	. "github.com/goodsign/gosmsc/contract"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postStatusCallback(h http.Handler, values url.Values) int {
+	r := httptest.NewRequest("POST", "/callback", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func callbackValues(secret string, id int64, phone string, status MessageStatusCode) url.Values {
+	code := strconv.Itoa(int(status))
+	return url.Values{
+		"id":     {strconv.FormatInt(id, 10)},
+		"phone":  {phone},
+		"status": {code},
+		"md5":    {CallbackSignature(secret, id, phone, code)},
+	}
+}
+
+func TestStatusCallback(t *testing.T) {
+	impl, err := newTestSenderCheckerImpl(&smscTestClientOptions{false, false, MessageStatusWaiting}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := impl.StatusCallbackHandler("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan StatusEvent, 10)
+	impl.Subscribe(func(event StatusEvent) {
+		received <- event
+	})
+	id, err := impl.Send("79211234567", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := callbackValues("wrong", id, "79211234567", MessageStatusComplete)
+	if code := postStatusCallback(h, values); code != http.StatusForbidden {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusForbidden, code)
+	}
+	values = callbackValues("secret", id, "79211234567", MessageStatusComplete)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusComplete {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusComplete, mstatus.StatusCode)
+	}
+	if mstatus.CallbackAt.IsZero() {
+		t.Fatal("Expected callback time to be set")
+	}
+	select {
+	case event := <-received:
+		if event.MessageId != id || event.NewStatusCode != MessageStatusComplete {
+			t.Fatalf("Unexpected event: '%v'", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Status event wasn't received")
+	}
+
+	// Callbacks of unknown messages are ignored.
+	values = callbackValues("secret", getNextMessageId(), "79211234567", MessageStatusComplete)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+}
+
+func TestCallbackReducesPolling(t *testing.T) {
+	impl, sint, err := newTestBatchSenderCheckerImpl(&smscTestClientOptions{false, false, MessageStatusWaiting}, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := impl.StatusCallbackHandler("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	polled, err := impl.Send("79211234567", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reported, err := impl.Send("79211234568", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := callbackValues("secret", reported, "79211234568", MessageStatusTransferred)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+
+	sint.m.Lock()
+	sizes := sint.batchSizes[:1] // The next check may be already running
+	sint.m.Unlock()
+	if sizes[0] != 1 {
+		t.Fatalf("Expected only message %d to be polled. Got batches '%v'", polled, sizes)
+	}
+	mstatus, err := impl.GetActualStatus(reported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusTransferred {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusTransferred, mstatus.StatusCode)
+	}
+}
+
+func TestStaleStatusCallback(t *testing.T) {
+	impl, err := newTestSenderCheckerImpl(&smscTestClientOptions{false, false, MessageStatusWaiting}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := impl.StatusCallbackHandler("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := impl.Send("79211234567", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+
+	values := callbackValues("secret", id, "79211234567", MessageStatusTransferred)
+	values.Set("ts", strconv.FormatInt(now, 10))
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+	// Callback of an earlier status comes late.
+	values = callbackValues("secret", id, "79211234567", MessageStatusWaiting)
+	values.Set("ts", strconv.FormatInt(now-60, 10))
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusTransferred {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusTransferred, mstatus.StatusCode)
+	}
+
+	// Final status is never overwritten.
+	values = callbackValues("secret", id, "79211234567", MessageStatusComplete)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+	values = callbackValues("secret", id, "79211234567", MessageStatusTransferred)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+	mstatus, err = impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusComplete {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusComplete, mstatus.StatusCode)
+	}
+}
+
+// callbackDuringFetchClient calls onFetch before it returns the polled status.
+type callbackDuringFetchClient struct {
+	*smsTestClientInternal
+	onFetch func()
+}
+
+func (c *callbackDuringFetchClient) FetchStatus(id int64, phone string) (*CheckStatusResponse, error) {
+	c.onFetch()
+	return c.smsTestClientInternal.FetchStatus(id, phone)
+}
+
+func TestCallbackDuringStatusRequest(t *testing.T) {
+	sint := &callbackDuringFetchClient{smsTestClientInternal: &smsTestClientInternal{&smscTestClientOptions{false, false, MessageStatusTransferred}}}
+	impl, err := newSenderCheckerImplInternal(sint, sint, newMessageStatusTestStorage(), time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := impl.StatusCallbackHandler("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := impl.Send("79211234567", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tracker holds the copy read before the callback.
+	sint.onFetch = func() {
+		values := callbackValues("secret", id, "79211234567", MessageStatusComplete)
+		if code := postStatusCallback(h, values); code != http.StatusOK {
+			t.Errorf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+		}
+	}
+
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+
+	mstatus, err := impl.GetActualStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusComplete {
+		t.Fatalf("Expected code = '%d'. Got '%d'", MessageStatusComplete, mstatus.StatusCode)
+	}
+}
+
+func TestStatusCallbackLegacyPhone(t *testing.T) {
+	storage := newMessageStatusTestStorage()
+	sint := &smsTestClientInternal{&smscTestClientOptions{false, false, MessageStatusWaiting}}
+	impl, err := newSenderCheckerImplInternal(sint, sint, storage, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := impl.StatusCallbackHandler("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored before phones were normalized.
+	id := getNextMessageId()
+	if err = storage.Put(NewUnknownMessageStatus(id, "8 (921) 123-45-67")); err != nil {
+		t.Fatal(err)
+	}
+
+	values := callbackValues("secret", id, "79001234567", MessageStatusComplete)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+	values = callbackValues("secret", id, "79211234567", MessageStatusTransferred)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+	mstatus, err := storage.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mstatus.StatusCode != MessageStatusTransferred || mstatus.Phone != "8 (921) 123-45-67" {
+		t.Fatalf("Expected code = '%d' of the legacy phone. Got '%d' of '%s'", MessageStatusTransferred, mstatus.StatusCode, mstatus.Phone)
+	}
+}
+
+func TestGatewayStatusCallback(t *testing.T) {
+	storage, err := NewMemoryStatusStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gateway := range []string{"", "first"} {
+		message := NewUnknownMessageStatus(1, "+79211234567")
+		message.Gateway = gateway
+		if err := storage.Put(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := NewGatewayStatusCallbackHandler(storage, "first", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := callbackValues("secret", 1, "79211234567", MessageStatusComplete)
+	if code := postStatusCallback(h, values); code != http.StatusOK {
+		t.Fatalf("Expected code = '%d'. Got '%d'", http.StatusOK, code)
+	}
+
+	// Message ids are unique per gateway only, so the message with the same id of another gateway is not updated.
+	for gateway, expected := range map[string]MessageStatusCode{"": MessageStatusCodeUnknown, "first": MessageStatusComplete} {
+		message, err := storage.GetRecipient(1, "+79211234567", gateway)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.StatusCode != expected {
+			t.Fatalf("Expected code = '%d' of gateway '%s'. Got '%d'", expected, gateway, message.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package gosmsc_test
+
+import (
+	"github.com/goodsign/gosmsc"
+	"github.com/goodsign/gosmsc/contract"
+	"github.com/goodsign/gosmsc/storagetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The test storage used by the package tests must behave as the real ones.
+func TestTestStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) contract.StatusContainer {
+		return gosmsc.NewMessageStatusTestStorage()
+	}, nil)
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) contract.StatusContainer {
+		storage, err := gosmsc.NewMemoryStatusStorage(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}, nil)
+}
+
+func TestBoltStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) contract.StatusContainer {
+		dir, err := ioutil.TempDir("", "gosmsc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage, err := gosmsc.NewMessageStatusBoltStorage(filepath.Join(dir, "messages.db"), nil)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			storage.Close()
+			os.RemoveAll(dir)
+		})
+		return storage
+	}, nil)
+}
@@ -0,0 +1,336 @@
+// Package storagetest contains the conformance tests of the StatusContainer implementations. The tests describe
+// the semantics the tracker and the callback handlers rely on, so every implementation runs them against itself:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) contract.StatusContainer { return newEmptyStorage(t) }, nil)
+//	}
+package storagetest
+
+import (
+	"fmt"
+	"github.com/goodsign/gosmsc"
+	. "github.com/goodsign/gosmsc/contract"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Options contains optional conformance test settings.
+type Options struct {
+	// TimePrecision is the precision of the stored times, e.g. time.Millisecond for MongoDB. Zero means
+	// times must be stored exactly.
+	TimePrecision time.Duration
+}
+
+// NewContainer returns an empty container. It is called by every test.
+type NewContainer func(t *testing.T) StatusContainer
+
+// Run runs all conformance tests as subtests of t. Recipient tests are run if the container implements
+// RecipientStatusContainer.
+func Run(t *testing.T, newContainer NewContainer, opts *Options) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, newContainer(t)) })
+	t.Run("Upsert", func(t *testing.T) { testUpsert(t, newContainer(t)) })
+	t.Run("Recipients", func(t *testing.T) { testRecipients(t, newContainer(t)) })
+	t.Run("Gateways", func(t *testing.T) { testGateways(t, newContainer(t)) })
+	t.Run("PendingFiltering", func(t *testing.T) { testPendingFiltering(t, newContainer(t)) })
+	t.Run("ConcurrentWriters", func(t *testing.T) { testConcurrentWriters(t, newContainer(t)) })
+	t.Run("TimeRoundTrip", func(t *testing.T) { testTimeRoundTrip(t, newContainer(t), opts.TimePrecision) })
+}
+
+func testNotFound(t *testing.T, c StatusContainer) {
+	if _, err := c.Get(1); err != gosmsc.MessageNotFound {
+		t.Fatalf("Expected MessageNotFound. Got '%v'", err)
+	}
+	pending, err := c.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending messages. Got '%d'", len(pending))
+	}
+
+	put(t, c, NewUnknownMessageStatus(1, "79000000001"))
+	if _, err = c.Get(2); err != gosmsc.MessageNotFound {
+		t.Fatalf("Expected MessageNotFound. Got '%v'", err)
+	}
+	if rc, ok := c.(RecipientStatusContainer); ok {
+		if _, err = rc.GetRecipient(1, "79000000002", ""); err != gosmsc.MessageNotFound {
+			t.Fatalf("Expected MessageNotFound for another phone. Got '%v'", err)
+		}
+	}
+	if err = c.Put(nil); err == nil {
+		t.Fatalf("Expected nil message error")
+	}
+}
+
+func testUpsert(t *testing.T, c StatusContainer) {
+	message := NewUnknownMessageStatus(1, "79000000001")
+	message.Options = &SendOptions{Sender: "sender", Valid: time.Hour, Flash: true}
+	message.Parts = 2
+	message.Gateway = "gateway"
+	put(t, c, message)
+
+	updated := *message
+	updated.StatusCode = MessageStatusTransferred
+	updated.Operator = "operator"
+	updated.Region = "region"
+	updated.Options = nil
+	put(t, c, &updated)
+
+	got := get(t, c, 1)
+	if got.StatusCode != MessageStatusTransferred || got.Operator != "operator" || got.Region != "region" ||
+		got.Options != nil || got.Parts != 2 || got.Gateway != "gateway" {
+		t.Fatalf("Put must overwrite the message. Expected '%v'. Got '%v'", updated, got)
+	}
+	pending := getPending(t, c)
+	if len(pending) != 1 {
+		t.Fatalf("Put must not duplicate the message. Got '%d' pending messages", len(pending))
+	}
+
+	updated.Options = message.Options
+	put(t, c, &updated)
+	got = get(t, c, 1)
+	if got.Options == nil || *got.Options != *message.Options {
+		t.Fatalf("Expected options '%v'. Got '%v'", message.Options, got.Options)
+	}
+
+	// The stored message doesn't depend on the put one.
+	updated.StatusCode = MessageStatusComplete
+	if got = get(t, c, 1); got.StatusCode != MessageStatusTransferred {
+		t.Fatalf("Stored message changed without Put. Got '%v'", got.StatusCode)
+	}
+}
+
+func testRecipients(t *testing.T, c StatusContainer) {
+	rc, ok := c.(RecipientStatusContainer)
+	if !ok {
+		t.Skip("Container doesn't implement RecipientStatusContainer")
+	}
+
+	put(t, c, NewUnknownMessageStatus(1, "79000000001"))
+	second := NewUnknownMessageStatus(1, "79000000002")
+	second.StatusCode = MessageStatusComplete
+	put(t, c, second)
+
+	got, err := rc.GetRecipient(1, "79000000002", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.StatusCode != MessageStatusComplete {
+		t.Fatalf("Recipients must be stored separately. Got '%v'", got)
+	}
+	if got, err = rc.GetRecipient(1, "79000000001", ""); err != nil || got.StatusCode != MessageStatusCodeUnknown {
+		t.Fatalf("Recipients must be stored separately. Got '%v', '%v'", got, err)
+	}
+	if got = get(t, c, 1); got.MessageId != 1 {
+		t.Fatalf("Expected a recipient of message %d. Got '%v'", 1, got)
+	}
+	pending := getPending(t, c)
+	if len(pending) != 1 || pending[0].Phone != "79000000001" {
+		t.Fatalf("Expected the first recipient to be pending. Got '%v'", pending)
+	}
+}
+
+func testGateways(t *testing.T, c StatusContainer) {
+	first := NewUnknownMessageStatus(1, "79000000001")
+	first.Gateway = "first"
+	put(t, c, first)
+	second := NewUnknownMessageStatus(1, "79000000001")
+	second.Gateway = "second"
+	second.StatusCode = MessageStatusComplete
+	put(t, c, second)
+
+	// Ids are unique per gateway only, so the messages are stored separately.
+	pending := getPending(t, c)
+	if len(pending) != 1 || pending[0].Gateway != "first" {
+		t.Fatalf("Messages of different gateways must be stored separately. Got pending '%v'", pending)
+	}
+	first.StatusCode = MessageStatusTransferred
+	put(t, c, first)
+	pending = getPending(t, c)
+	if len(pending) != 1 || pending[0].Gateway != "first" || pending[0].StatusCode != MessageStatusTransferred {
+		t.Fatalf("Put must overwrite the message of the same gateway only. Got pending '%v'", pending)
+	}
+	if got := get(t, c, 1); got.Gateway != "first" && got.Gateway != "second" {
+		t.Fatalf("Expected a message of one of the gateways. Got '%v'", got)
+	}
+
+	rc, ok := c.(RecipientStatusContainer)
+	if !ok {
+		return
+	}
+	for _, gateway := range []string{"first", "second"} {
+		got, err := rc.GetRecipient(1, "79000000001", gateway)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Gateway != gateway {
+			t.Fatalf("Expected message of gateway '%s'. Got '%s'", gateway, got.Gateway)
+		}
+	}
+	if _, err := rc.GetRecipient(1, "79000000001", ""); err != gosmsc.MessageNotFound {
+		t.Fatalf("Expected MessageNotFound for a gateway without messages. Got '%v'", err)
+	}
+}
+
+func testPendingFiltering(t *testing.T, c StatusContainer) {
+	expected := make(map[int64]bool)
+	id := int64(0)
+	add := func(code MessageStatusCode, errorCode int32) {
+		id++
+		message := NewUnknownMessageStatus(id, "79000000001")
+		message.StatusCode = code
+		message.StatusErrorCode = errorCode
+		put(t, c, message)
+		if message.IsPending() {
+			expected[id] = true
+		}
+	}
+	for _, code := range []MessageStatusCode{MessageStatusCodeUnknown, MessageStatusJustSent, MessageStatusWaiting,
+		MessageStatusTransferred} {
+		add(code, 0)
+		add(code, 1)
+	}
+	for _, code := range FinalMessageStatusCodes() {
+		add(code, 0)
+	}
+	checkPending(t, c, expected)
+
+	// Messages leave and reenter the pending set on update.
+	message := get(t, c, 1)
+	message.StatusCode = MessageStatusComplete
+	put(t, c, message)
+	delete(expected, 1)
+	checkPending(t, c, expected)
+
+	message = get(t, c, 2)
+	message.StatusErrorCode = 0
+	put(t, c, message)
+	expected[2] = true
+	checkPending(t, c, expected)
+}
+
+func testConcurrentWriters(t *testing.T, c StatusContainer) {
+	const writers = 8
+	const messagesPerWriter = 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < messagesPerWriter; i++ {
+				message := NewUnknownMessageStatus(int64(w*messagesPerWriter+i+1), "79000000001")
+				if err := c.Put(message); err != nil {
+					errs <- err
+					return
+				}
+				// Every other message is completed by the second Put.
+				if i%2 == 1 {
+					message.StatusCode = MessageStatusComplete
+					if err := c.Put(message); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for id := int64(1); id <= writers*messagesPerWriter; id++ {
+		get(t, c, id)
+	}
+	pending := getPending(t, c)
+	if expected := writers * (messagesPerWriter + 1) / 2; len(pending) != expected {
+		t.Fatalf("Expected %d pending messages. Got '%d'", expected, len(pending))
+	}
+}
+
+func testTimeRoundTrip(t *testing.T, c StatusContainer, precision time.Duration) {
+	location := time.FixedZone("UTC+3", 3*60*60)
+	message := NewUnknownMessageStatus(1, "79000000001")
+	message.CreatedAt = time.Date(2014, 7, 1, 12, 30, 15, 123456789, location)
+	message.StatusUpdatedAt = time.Date(2014, 7, 1, 12, 31, 0, 987654321, location)
+	put(t, c, message)
+
+	got := get(t, c, 1)
+	checkTime(t, "CreatedAt", message.CreatedAt, got.CreatedAt, precision)
+	checkTime(t, "StatusUpdatedAt", message.StatusUpdatedAt, got.StatusUpdatedAt, precision)
+	if !got.CallbackAt.IsZero() {
+		t.Fatalf("Expected zero CallbackAt. Got '%v'", got.CallbackAt)
+	}
+
+	pending := getPending(t, c)
+	if len(pending) != 1 {
+		t.Fatalf("Expected %d pending message. Got '%d'", 1, len(pending))
+	}
+	checkTime(t, "pending CreatedAt", message.CreatedAt, pending[0].CreatedAt, precision)
+}
+
+func checkTime(t *testing.T, name string, expected time.Time, got time.Time, precision time.Duration) {
+	diff := got.Sub(expected)
+	if diff < 0 {
+		diff = -diff
+	}
+	if precision == 0 && diff != 0 || precision != 0 && diff >= precision {
+		t.Fatalf("%s differs more than precision %v. Expected '%v'. Got '%v'", name, precision, expected, got)
+	}
+}
+
+func checkPending(t *testing.T, c StatusContainer, expected map[int64]bool) {
+	pending := getPending(t, c)
+	got := make(map[int64]bool)
+	for _, message := range pending {
+		if !message.IsPending() {
+			t.Fatalf("GetPending returned message %d which is not pending: '%v'", message.MessageId, message)
+		}
+		got[message.MessageId] = true
+	}
+	if len(pending) != len(expected) || len(got) != len(expected) {
+		t.Fatalf("Expected pending messages %v. Got '%v'", ids(expected), ids(got))
+	}
+	for id := range expected {
+		if !got[id] {
+			t.Fatalf("Expected pending messages %v. Got '%v'", ids(expected), ids(got))
+		}
+	}
+}
+
+func ids(set map[int64]bool) string {
+	var ids []int64
+	for id := range set {
+		ids = append(ids, id)
+	}
+	return fmt.Sprint(ids)
+}
+
+func put(t *testing.T, c StatusContainer, message *MessageStatus) {
+	if err := c.Put(message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, c StatusContainer, id int64) *MessageStatus {
+	message, err := c.Get(id)
+	if err != nil {
+		t.Fatalf("Get %d failed: '%v'", id, err)
+	}
+	return message
+}
+
+func getPending(t *testing.T, c StatusContainer) []MessageStatus {
+	pending, err := c.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pending
+}
@@ -1,16 +1,50 @@
 package gosmsc
 
 import (
+	"context"
 	"fmt"
 	. "github.com/goodsign/gosmsc/contract"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	DefaultUpdateInterval = time.Minute
+	DefaultUpdateInterval  = time.Minute
+	DefaultStatusBatchSize = 100
+	DefaultEventQueueSize  = 100
+
+	DefaultCallbackPollInterval = 30 * time.Minute
 )
 
+// TrackerOptions contains optional tracker settings. Zero values mean defaults.
+type TrackerOptions struct {
+	// MaxTrackingAge limits the time since message creation during which it is polled. Older
+	// messages are marked as MessageStatusAbandoned and are not polled anymore. Zero means no limit.
+	MaxTrackingAge time.Duration
+
+	// BatchSize is the max number of messages which statuses are fetched in one gateway call if the
+	// status fetcher implements BatchStatusFetcher. Zero means DefaultStatusBatchSize, 1 disables batching.
+	BatchSize int
+
+	// Workers is the number of goroutines polling the gateway concurrently during a check. Zero means 1.
+	// If it is greater than 1, the storage and the status fetcher must be safe for concurrent use.
+	Workers int
+
+	// CheckTimeout limits the duration of a single check of all pending messages. Gateway calls
+	// that are still in progress when it expires are cancelled. Zero means no limit.
+	CheckTimeout time.Duration
+
+	// EventQueueSize is the number of status change events buffered for each subscriber.
+	// Zero means DefaultEventQueueSize.
+	EventQueueSize int
+
+	// CallbackPollInterval is the polling interval of messages which statuses were pushed by the gateway
+	// callback (see StatusCallbackHandler). Polling serves as a safety net for lost callbacks.
+	// Zero means DefaultCallbackPollInterval.
+	CallbackPollInterval time.Duration
+}
+
 // MessageTracker represents a running goroutine that polls SMSC service to track status of sent messages
 // which status is pending. This object is created when a goroutine is started by StartTracking and
 // can be used to stop the goroutine using Close func. After goroutine is stopped by Close() this
@@ -22,6 +56,13 @@ type MessageTracker struct {
 	tickerForTest chan bool // Used to create artificial ticks from tests
 	stopped       bool
 	stopChannel   chan bool // Used to signal the polling goroutine to stop and finish
+	done          chan bool // Closed when the polling goroutine finishes
+	ctx           context.Context
+	cancel        context.CancelFunc // Aborts gateway calls that are in progress when tracker is stopped
+	opts          TrackerOptions
+	subsM         sync.RWMutex
+	subs          map[*statusSubscription]bool
+	polledAt      map[string]time.Time // Last poll time of the messages receiving callbacks by statusRequestKey
 }
 
 // StartTracking creates a new tracker for the specified storage and starts the tracking process
@@ -29,6 +70,13 @@ type MessageTracker struct {
 // messages are needed.
 // To stop it, call Close on the returned tracker instance.
 func StartTracking(storage StatusContainer, statusFetcher StatusFetcher, updateInterval time.Duration) (tracker *MessageTracker, e error) {
+	return StartTrackingWithOptions(storage, statusFetcher, updateInterval, nil)
+}
+
+// StartTrackingWithOptions is the same as StartTracking, but also accepts optional tracker settings.
+// Nil opts are equal to zero TrackerOptions.
+func StartTrackingWithOptions(storage StatusContainer, statusFetcher StatusFetcher, updateInterval time.Duration,
+	opts *TrackerOptions) (tracker *MessageTracker, e error) {
 	if updateInterval <= 0 {
 		return nil, fmt.Errorf("updateInterval cannot be zero or negative")
 	}
@@ -38,18 +86,61 @@ func StartTracking(storage StatusContainer, statusFetcher StatusFetcher, updateI
 	if statusFetcher == nil {
 		return nil, fmt.Errorf("Message tracker statusFetcher parameter cannot be nil")
 	}
-	tracker = &MessageTracker{sync.Mutex{}, storage, statusFetcher, make(chan bool), false, make(chan bool, 1)}
+	if opts == nil {
+		opts = new(TrackerOptions)
+	}
+	if opts.MaxTrackingAge < 0 {
+		return nil, fmt.Errorf("MaxTrackingAge cannot be negative")
+	}
+	if opts.BatchSize < 0 {
+		return nil, fmt.Errorf("BatchSize cannot be negative")
+	}
+	if opts.Workers < 0 {
+		return nil, fmt.Errorf("Workers cannot be negative")
+	}
+	if opts.CheckTimeout < 0 {
+		return nil, fmt.Errorf("CheckTimeout cannot be negative")
+	}
+	if opts.EventQueueSize < 0 {
+		return nil, fmt.Errorf("EventQueueSize cannot be negative")
+	}
+	if opts.CallbackPollInterval < 0 {
+		return nil, fmt.Errorf("CallbackPollInterval cannot be negative")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker = &MessageTracker{
+		storage:       storage,
+		statusFetcher: statusFetcher,
+		tickerForTest: make(chan bool),
+		stopChannel:   make(chan bool, 1),
+		done:          make(chan bool),
+		ctx:           ctx,
+		cancel:        cancel,
+		opts:          *opts,
+		subs:          make(map[*statusSubscription]bool),
+		polledAt:      make(map[string]time.Time),
+	}
 
 	go func(t *MessageTracker) {
+		defer close(t.done)
 		ticker := time.NewTicker(updateInterval)
+		defer ticker.Stop()
 		for !t.IsStopped() {
 			select {
 			case <-t.tickerForTest:
-				t.checkPending()
+				t.runCheck()
 			case <-ticker.C:
-				t.checkPending()
+				t.runCheck()
 			case <-t.stopChannel:
 			}
+
+			// Checks never overlap: a tick that came while the check was still running is skipped
+			// instead of starting the next check right away.
+			select {
+			case <-ticker.C:
+				logger.Warn("Pending messages check took longer than update interval, skipping tick")
+			default:
+			}
 		}
 	}(tracker)
 
@@ -67,7 +158,7 @@ func (t *MessageTracker) IsStopped() bool {
 // cannot be used anymore.
 //
 // NOTE 1: Goroutine doesn't terminate immediately (it can be processing pending issues), but
-// Stop func is non blocking itself.
+// Stop func is non blocking itself. Gateway calls that are in progress are cancelled.
 func (t *MessageTracker) Stop() error {
 	t.stopM.Lock()
 	defer t.stopM.Unlock()
@@ -75,43 +166,249 @@ func (t *MessageTracker) Stop() error {
 		return fmt.Errorf("Already stopped")
 	}
 	t.stopped = true
+	t.cancel()
 	t.stopChannel <- true
 	close(t.tickerForTest)
 	close(t.stopChannel)
+	t.unsubscribeAll()
 	return nil
 }
 
-func (t *MessageTracker) checkPending() error {
+// runCheck checks pending messages once, limiting the check duration by CheckTimeout.
+func (t *MessageTracker) runCheck() {
+	ctx := t.ctx
+	if t.opts.CheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.opts.CheckTimeout)
+		defer cancel()
+	}
+	err := t.checkPending(ctx)
+	if err != nil {
+		logger.Warnf("Pending messages check aborted: '%s'", err)
+	}
+}
+
+// checkPending fetches statuses of all pending messages using a pool of workers and waits until
+// they are done.
+func (t *MessageTracker) checkPending(ctx context.Context) error {
 	pendingMessages, err := t.storage.GetPending()
 	if err != nil {
 		return logger.Error(err)
 	}
 
+	var messages []MessageStatus
+	polledAt := make(map[string]time.Time)
 	for _, message := range pendingMessages {
-		logger.Debugf("Checking message %v", message.MessageId)
-		output, err := t.statusFetcher.FetchStatus(message.MessageId, message.Phone)
-		if err != nil {
-			logger.Error(err)
+		if !message.IsPending() {
+			continue
+		}
+		if t.isTooOld(&message) {
+			t.abandon(&message)
 			continue
 		}
+		if !message.CallbackAt.IsZero() {
+			if !t.needsSafetyPoll(&message) {
+				key := statusRequestKey(message.MessageId, message.Phone)
+				polledAt[key] = t.polledAt[key]
+				continue
+			}
+			polledAt[statusRequestKey(message.MessageId, message.Phone)] = time.Now()
+		}
+		messages = append(messages, message)
+	}
+	// Only the messages that are still pending are remembered.
+	t.polledAt = polledAt
+
+	if t.opts.Workers < 2 {
+		return t.queueChecks(ctx, messages, nil)
+	}
 
-		message.StatusCode = MessageStatusCode(output.StatusCode)
-		message.Operator = output.Operator
-		message.Region = output.Region
-		message.StatusErrorCode = output.StatusErrorCode
+	jobs := make(chan func())
+	var wg sync.WaitGroup
+	for i := 0; i < t.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+	err = t.queueChecks(ctx, messages, jobs)
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
 
-		statusUpdatedAt, err := time.Parse("02.01.2006 15:04:05", output.StatusDate)
-		if err != nil {
-			logger.Error(err)
-		} else {
-			message.StatusUpdatedAt = statusUpdatedAt.Local()
+// queueChecks splits the messages into single or batch status checks and sends them to the workers.
+// If there are no workers, the checks are run one by one in the calling goroutine.
+func (t *MessageTracker) queueChecks(ctx context.Context, messages []MessageStatus, jobs chan<- func()) error {
+	batchSize := t.opts.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultStatusBatchSize
+	}
+	batchFetcher, ok := t.statusFetcher.(BatchStatusFetcher)
+	if !ok || batchSize < 2 {
+		batchSize = 1
+	}
+
+	for start := 0; start < len(messages); start += batchSize {
+		end := start + batchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		batch := messages[start:end]
+		job := func() {
+			if batchSize == 1 {
+				t.checkMessage(ctx, &batch[0])
+			} else {
+				t.checkBatch(ctx, batchFetcher, batch)
+			}
 		}
+		if jobs == nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			job()
+			continue
+		}
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return ctx.Err()
+}
+
+func (t *MessageTracker) checkMessage(ctx context.Context, message *MessageStatus) {
+	logger.Debugf("Checking message %v", message.MessageId)
+	output, err := fetchMessageStatusContext(ctx, t.statusFetcher, message)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	t.update(message, output)
+}
+
+func (t *MessageTracker) checkBatch(ctx context.Context, fetcher BatchStatusFetcher, messages []MessageStatus) {
+	logger.Debugf("Checking %d messages in batch", len(messages))
+	requests := make([]StatusRequest, len(messages))
+	for i, message := range messages {
+		requests[i] = StatusRequest{Id: message.MessageId, Phone: message.Phone}
+	}
+	outputs, err := fetcher.FetchStatusBatch(ctx, requests)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
 
-		err = t.storage.Put(&message)
-		if err != nil {
-			logger.Error(err)
+	byKey := make(map[string]*CheckStatusResponse, len(outputs))
+	for i := range outputs {
+		byKey[statusRequestKey(outputs[i].Id, outputs[i].Phone)] = &outputs[i]
+	}
+	for i := range messages {
+		output, ok := byKey[statusRequestKey(messages[i].MessageId, messages[i].Phone)]
+		if !ok {
+			logger.Errorf("Message %v: no status in batch response", messages[i].MessageId)
 			continue
 		}
+		t.update(&messages[i], output)
 	}
-	return nil
+}
+
+// update applies the fetched status to the message and saves it.
+func (t *MessageTracker) update(message *MessageStatus, output *CheckStatusResponse) {
+	if err := output.Err(); err != nil {
+		logger.Errorf("Message %v: %s", message.MessageId, err)
+		return
+	}
+
+	if t.changedSinceRead(message) {
+		logger.Debugf("Message %v was updated since it was read, polled status '%s' is dropped", message.MessageId,
+			MessageStatusCode(output.StatusCode))
+		return
+	}
+
+	old := *message
+	message.StatusCode = MessageStatusCode(output.StatusCode)
+	message.Operator = output.Operator
+	message.Region = output.Region
+	message.StatusErrorCode = output.StatusErrorCode
+
+	statusUpdatedAt, err := time.Parse(smscDateLayout, output.StatusDate)
+	if err != nil {
+		logger.Error(err)
+	} else {
+		message.StatusUpdatedAt = statusUpdatedAt.Local()
+	}
+
+	err = t.storage.Put(message)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	t.publishChange(&old, message)
+	if message.StatusCode.IsFinal() {
+		logger.Debugf("Message %v reached final status '%s'", message.MessageId, message.StatusCode)
+	}
+}
+
+// changedSinceRead returns true if the stored message differs from the one read by the tracker, e.g. because
+// a status callback updated it during the status request. The stored status is newer then, so the polled one
+// must not overwrite it.
+func (t *MessageTracker) changedSinceRead(message *MessageStatus) bool {
+	current, err := getRecipient(t.storage, message.MessageId, message.Phone, message.Gateway)
+	if err != nil {
+		return false
+	}
+	return current.StatusCode != message.StatusCode || current.StatusErrorCode != message.StatusErrorCode ||
+		!current.StatusUpdatedAt.Equal(message.StatusUpdatedAt) || !current.CallbackAt.Equal(message.CallbackAt)
+}
+
+// statusRequestKey identifies a message recipient, as one message can be sent to several phones. The gateway returns phones in its own format,
+// so only digits are compared.
+func statusRequestKey(id int64, phone string) string {
+	return fmt.Sprintf("%d:%s", id, strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, phone))
+}
+
+// needsSafetyPoll returns true if a message receiving callbacks wasn't polled or got a callback
+// during the CallbackPollInterval.
+func (t *MessageTracker) needsSafetyPoll(message *MessageStatus) bool {
+	interval := t.opts.CallbackPollInterval
+	if interval == 0 {
+		interval = DefaultCallbackPollInterval
+	}
+	last := t.polledAt[statusRequestKey(message.MessageId, message.Phone)]
+	if message.CallbackAt.After(last) {
+		last = message.CallbackAt
+	}
+	return time.Since(last) > interval
+}
+
+// isTooOld returns true if the message was tracked longer than MaxTrackingAge.
+func (t *MessageTracker) isTooOld(message *MessageStatus) bool {
+	return t.opts.MaxTrackingAge > 0 && time.Since(message.CreatedAt) > t.opts.MaxTrackingAge
+}
+
+// abandon marks the message so that it is not polled anymore.
+func (t *MessageTracker) abandon(message *MessageStatus) {
+	logger.Debugf("Message %v exceeded max tracking age, abandoning", message.MessageId)
+	old := *message
+	message.StatusCode = MessageStatusAbandoned
+	message.StatusUpdatedAt = time.Now()
+	err := t.storage.Put(message)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	t.publishChange(&old, message)
 }
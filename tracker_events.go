@@ -0,0 +1,95 @@
+package gosmsc
+
+import (
+	. "github.com/goodsign/gosmsc/contract"
+)
+
+// statusSubscription is a queue of events of a single subscriber.
+type statusSubscription struct {
+	queue chan StatusEvent
+}
+
+// Subscribe registers a listener that is called for every status change of the tracked messages.
+// Returns a func that cancels the subscription.
+//
+// Each listener is called sequentially in its own goroutine, so events of a message come to it in the
+// order of the status changes. The tracker never waits for listeners: events are queued (see
+// TrackerOptions.EventQueueSize) and if the queue of a slow listener is full, new events for it are
+// dropped and logged.
+func (t *MessageTracker) Subscribe(listener StatusListener) (unsubscribe func()) {
+	events, unsubscribe := t.SubscribeChannel()
+	go func() {
+		for event := range events {
+			listener(event)
+		}
+	}()
+	return unsubscribe
+}
+
+// SubscribeChannel is the same as Subscribe, but returns the event queue itself. The channel is closed when
+// the subscription is cancelled or the tracker is stopped. If the reader is too slow, events are dropped.
+func (t *MessageTracker) SubscribeChannel() (events <-chan StatusEvent, unsubscribe func()) {
+	size := t.opts.EventQueueSize
+	if size == 0 {
+		size = DefaultEventQueueSize
+	}
+	sub := &statusSubscription{make(chan StatusEvent, size)}
+
+	t.subsM.Lock()
+	defer t.subsM.Unlock()
+	if t.subs == nil {
+		// Tracker is stopped.
+		close(sub.queue)
+		return sub.queue, func() {}
+	}
+	t.subs[sub] = true
+	return sub.queue, func() { t.unsubscribe(sub) }
+}
+
+func (t *MessageTracker) unsubscribe(sub *statusSubscription) {
+	t.subsM.Lock()
+	defer t.subsM.Unlock()
+	if t.subs[sub] {
+		delete(t.subs, sub)
+		close(sub.queue)
+	}
+}
+
+func (t *MessageTracker) unsubscribeAll() {
+	t.subsM.Lock()
+	defer t.subsM.Unlock()
+	for sub := range t.subs {
+		close(sub.queue)
+	}
+	t.subs = nil
+}
+
+// publish queues the event for all subscribers without blocking.
+func (t *MessageTracker) publish(event StatusEvent) {
+	t.subsM.RLock()
+	defer t.subsM.RUnlock()
+	for sub := range t.subs {
+		select {
+		case sub.queue <- event:
+		default:
+			logger.Warnf("Subscriber queue is full, dropping status event of message %v", event.MessageId)
+		}
+	}
+}
+
+// publishChange publishes an event if the status code or the error code of the message changed.
+func (t *MessageTracker) publishChange(old *MessageStatus, message *MessageStatus) {
+	if old.StatusCode == message.StatusCode && old.StatusErrorCode == message.StatusErrorCode {
+		return
+	}
+	t.publish(StatusEvent{
+		MessageId:       message.MessageId,
+		Phone:           message.Phone,
+		Gateway:         message.Gateway,
+		OldStatusCode:   old.StatusCode,
+		NewStatusCode:   message.StatusCode,
+		Operator:        message.Operator,
+		StatusErrorCode: message.StatusErrorCode,
+		Timestamp:       message.StatusUpdatedAt,
+	})
+}
@@ -0,0 +1,225 @@
+package gosmsc
+
+import (
+	"context"
+	. "github.com/goodsign/gosmsc/contract"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedStatusFetcher blocks every status request until it is released or its context is done
+// and records the max number of concurrent requests and the requested ids.
+type gatedStatusFetcher struct {
+	m       sync.Mutex
+	active  int
+	max     int
+	calls   int
+	ids     []int64
+	started chan bool
+	release chan bool
+}
+
+func newGatedStatusFetcher() *gatedStatusFetcher {
+	return &gatedStatusFetcher{started: make(chan bool, 100), release: make(chan bool)}
+}
+
+func (f *gatedStatusFetcher) FetchStatus(id int64, phone string) (*CheckStatusResponse, error) {
+	return f.FetchStatusContext(context.Background(), id, phone)
+}
+
+func (f *gatedStatusFetcher) FetchStatusContext(ctx context.Context, id int64, phone string) (*CheckStatusResponse, error) {
+	f.m.Lock()
+	f.active++
+	f.calls++
+	f.ids = append(f.ids, id)
+	if f.active > f.max {
+		f.max = f.active
+	}
+	f.m.Unlock()
+	defer func() {
+		f.m.Lock()
+		f.active--
+		f.m.Unlock()
+	}()
+
+	f.started <- true
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &CheckStatusResponse{StatusCode: int32(MessageStatusComplete), StatusDate: "02.01.2006 15:04:05"}, nil
+}
+
+func (f *gatedStatusFetcher) stats() (max int, calls int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.max, f.calls
+}
+
+func putPendingMessages(t *testing.T, storage StatusContainer, count int) {
+	for i := 0; i < count; i++ {
+		if err := storage.Put(NewUnknownMessageStatus(getNextMessageId(), "+7 921 123 45 67")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTrackerWorkers(t *testing.T) {
+	storage := newMessageStatusTestStorage()
+	putPendingMessages(t, storage, 6)
+	fetcher := newGatedStatusFetcher()
+	tracker, err := StartTrackingWithOptions(storage, fetcher, time.Hour, &TrackerOptions{Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Stop()
+
+	tracker.tickerForTest <- false
+	for i := 0; i < 3; i++ {
+		<-fetcher.started
+	}
+
+	// The second tick must wait until the first check is over, so checks never overlap.
+	secondTick := make(chan bool)
+	go func() {
+		tracker.tickerForTest <- false
+		close(secondTick)
+	}()
+	select {
+	case <-secondTick:
+		t.Fatal("Second check started while the first one is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 6; i++ {
+		fetcher.release <- true
+		if i < 3 {
+			<-fetcher.started
+		}
+	}
+	<-secondTick
+
+	max, calls := fetcher.stats()
+	if max != 3 {
+		t.Fatalf("Expected 3 concurrent requests. Got '%d'", max)
+	}
+	if calls != 6 {
+		t.Fatalf("Expected 6 requests. Got '%d'", calls)
+	}
+	pending, err := storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending messages. Got '%d'", len(pending))
+	}
+}
+
+func TestTrackerCheckTimeout(t *testing.T) {
+	storage := newMessageStatusTestStorage()
+	putPendingMessages(t, storage, 2)
+	pending, err := storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := pending[0].MessageId
+	fetcher := newGatedStatusFetcher()
+	tracker, err := StartTrackingWithOptions(storage, fetcher, time.Hour, &TrackerOptions{CheckTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Stop()
+
+	tracker.tickerForTest <- false
+	tracker.tickerForTest <- false // Returns when the first check is over
+	<-fetcher.started
+	<-fetcher.started // The first request of the second check
+
+	// Each check times out on the request of the first message and is aborted before the second one.
+	fetcher.m.Lock()
+	ids := fetcher.ids
+	fetcher.m.Unlock()
+	if len(ids) != 2 || ids[0] != first || ids[1] != first {
+		t.Fatalf("Expected 2 requests of message %d. Got '%v'", first, ids)
+	}
+	pending, err = storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].MessageId != first || pending[0].StatusCode != MessageStatusCodeUnknown {
+		t.Fatalf("Expected the timed out message %d to be pending. Got '%v'", first, pending)
+	}
+}
+
+func TestStatusEvents(t *testing.T) {
+	expectedCode := MessageStatusCode(555)
+	impl, err := newTestSenderCheckerImpl(&smscTestClientOptions{false, false, expectedCode}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan StatusEvent, 10)
+	unsubscribe := impl.Subscribe(func(event StatusEvent) {
+		received <- event
+	})
+	id, err := impl.Send("+7 921 123 45 67", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl.tracker.tickerForTest <- false
+	impl.tracker.tickerForTest <- false // Returns when the first check is over
+
+	select {
+	case event := <-received:
+		if event.MessageId != id || event.OldStatusCode != MessageStatusCodeUnknown || event.NewStatusCode != expectedCode {
+			t.Fatalf("Unexpected event: '%v'", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Status event wasn't received")
+	}
+
+	// Status didn't change during the second check.
+	impl.tracker.tickerForTest <- false
+	select {
+	case event := <-received:
+		t.Fatalf("Unexpected event: '%v'", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unsubscribe()
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	storage := newMessageStatusTestStorage()
+	putPendingMessages(t, storage, 3)
+	sint := &smsTestClientInternal{&smscTestClientOptions{false, false, MessageStatusComplete}}
+	tracker, err := StartTrackingWithOptions(storage, sint, time.Hour, &TrackerOptions{EventQueueSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := tracker.SubscribeChannel()
+
+	tracker.tickerForTest <- false
+	tracker.tickerForTest <- false // Returns when the first check is over
+
+	// The queue holds one event, the rest are dropped and the tracker isn't blocked.
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 queued event. Got '%d'", len(events))
+	}
+	pending, err := storage.GetPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending messages. Got '%d'", len(pending))
+	}
+
+	unsubscribe()
+	<-events
+	if _, ok := <-events; ok {
+		t.Fatal("Expected events channel to be closed")
+	}
+	if err = tracker.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
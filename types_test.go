@@ -1,6 +1,7 @@
 package gosmsc
 
 import (
+	"context"
 	"fmt"
 	. "github.com/goodsign/gosmsc/contract"
 	"sync"
@@ -33,10 +34,10 @@ func (c *smsTestClientInternal) Send(phone string, text string) (*SendSMSRespons
 		return nil, fmt.Errorf("Some io error")
 	}
 	if c.opts.invalidCreds {
-		return &SendSMSResponse{"Invalid credentials", -123, 0}, nil
+		return &SendSMSResponse{"Invalid credentials", 2, 0, ""}, nil
 	}
 
-	return &SendSMSResponse{"", 0, getNextMessageId()}, nil
+	return &SendSMSResponse{"", 0, getNextMessageId(), ""}, nil
 }
 
 func (c *smsTestClientInternal) FetchStatus(id int64, phone string) (*CheckStatusResponse, error) {
@@ -44,10 +45,33 @@ func (c *smsTestClientInternal) FetchStatus(id int64, phone string) (*CheckStatu
 		return nil, fmt.Errorf("Some io error")
 	}
 	if c.opts.invalidCreds {
-		return &CheckStatusResponse{0, "", "", "", 0, "Invalid credentials", -123}, nil
+		return &CheckStatusResponse{0, "", "", "", 0, "Invalid credentials", 2, 0, ""}, nil
 	}
 
-	return &CheckStatusResponse{int32(c.opts.expectedStatusCode), "02.01.2006 15:04:05", "", "", 0, "", 0}, nil
+	return &CheckStatusResponse{int32(c.opts.expectedStatusCode), "02.01.2006 15:04:05", "", "", 0, "", 0, id, phone}, nil
+}
+
+// smsTestBatchClientInternal is a test client that also supports batch status requests and counts them.
+type smsTestBatchClientInternal struct {
+	*smsTestClientInternal
+	m          sync.Mutex
+	batchSizes []int
+}
+
+func (c *smsTestBatchClientInternal) FetchStatusBatch(ctx context.Context, requests []StatusRequest) ([]CheckStatusResponse, error) {
+	c.m.Lock()
+	c.batchSizes = append(c.batchSizes, len(requests))
+	c.m.Unlock()
+
+	var outputs []CheckStatusResponse
+	for _, r := range requests {
+		output, err := c.FetchStatus(r.Id, r.Phone)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *output)
+	}
+	return outputs, nil
 }
 
 // messageStatusTestStorage is a default mgo implementation of the MessageStatusStorageInterface.
@@ -60,6 +84,11 @@ func newMessageStatusTestStorage() *messageStatusTestStorage {
 	return &messageStatusTestStorage{}
 }
 
+// NewMessageStatusTestStorage makes the test storage available to the conformance tests of the gosmsc_test package.
+func NewMessageStatusTestStorage() StatusContainer {
+	return newMessageStatusTestStorage()
+}
+
 func (ms *messageStatusTestStorage) Get(messageId int64) (*MessageStatus, error) {
 	ms.m.Lock()
 	defer ms.m.Unlock()
@@ -80,7 +109,7 @@ func (ms *messageStatusTestStorage) Put(message *MessageStatus) error {
 		return fmt.Errorf("message is nil")
 	}
 	for i, v := range ms.msgs {
-		if v.MessageId == message.MessageId {
+		if v.MessageId == message.MessageId && v.Phone == message.Phone && v.Gateway == message.Gateway {
 			ms.msgs[i] = *message
 			return nil
 		}
@@ -89,13 +118,25 @@ func (ms *messageStatusTestStorage) Put(message *MessageStatus) error {
 	return nil
 }
 
+func (ms *messageStatusTestStorage) GetRecipient(messageId int64, phone string, gateway string) (*MessageStatus, error) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	for _, v := range ms.msgs {
+		if v.MessageId == messageId && v.Phone == phone && v.Gateway == gateway {
+			return &v, nil
+		}
+	}
+	return nil, MessageNotFound
+}
+
 func (ms *messageStatusTestStorage) GetPending() ([]MessageStatus, error) {
 	ms.m.Lock()
 	defer ms.m.Unlock()
 
 	var p []MessageStatus
 	for _, v := range ms.msgs {
-		if v.StatusCode != MessageStatusComplete {
+		if v.IsPending() {
 			p = append(p, v)
 		}
 	}
@@ -103,6 +144,87 @@ func (ms *messageStatusTestStorage) GetPending() ([]MessageStatus, error) {
 }
 
 func newTestSenderCheckerImpl(opts *smscTestClientOptions, updateInterval time.Duration) (*SenderCheckerImpl, error) {
+	return newTestSenderCheckerImplWithOptions(opts, updateInterval, nil)
+}
+
+func newTestSenderCheckerImplWithOptions(opts *smscTestClientOptions, updateInterval time.Duration, checkerOpts *SenderCheckerOptions) (*SenderCheckerImpl, error) {
 	sint := &smsTestClientInternal{opts}
-	return newSenderCheckerImplInternal(sint, sint, newMessageStatusTestStorage(), updateInterval)
+	return newSenderCheckerImplInternal(sint, sint, newMessageStatusTestStorage(), updateInterval, checkerOpts)
+}
+
+func newTestBatchSenderCheckerImpl(opts *smscTestClientOptions, updateInterval time.Duration, checkerOpts *SenderCheckerOptions) (*SenderCheckerImpl, *smsTestBatchClientInternal, error) {
+	sint := &smsTestBatchClientInternal{smsTestClientInternal: &smsTestClientInternal{opts}}
+	impl, err := newSenderCheckerImplInternal(sint, sint, newMessageStatusTestStorage(), updateInterval, checkerOpts)
+	return impl, sint, err
+}
+
+// incomingTestStorage is an in-memory IncomingContainer.
+type incomingTestStorage struct {
+	m    sync.Mutex
+	msgs []IncomingMessage
+}
+
+func (is *incomingTestStorage) PutIncoming(message *IncomingMessage) error {
+	is.m.Lock()
+	defer is.m.Unlock()
+
+	for _, v := range is.msgs {
+		if v.Id == message.Id {
+			return nil
+		}
+	}
+	is.msgs = append(is.msgs, *message)
+	return nil
+}
+
+func (is *incomingTestStorage) GetIncoming(id int64) (*IncomingMessage, error) {
+	is.m.Lock()
+	defer is.m.Unlock()
+
+	for _, v := range is.msgs {
+		if v.Id == id {
+			return &v, nil
+		}
+	}
+	return nil, IncomingMessageNotFound
+}
+
+func (is *incomingTestStorage) ListIncoming(unacknowledgedOnly bool, limit int) ([]IncomingMessage, error) {
+	is.m.Lock()
+	defer is.m.Unlock()
+
+	var l []IncomingMessage
+	for _, v := range is.msgs {
+		if (!unacknowledgedOnly || !v.Acknowledged) && (limit == 0 || len(l) < limit) {
+			l = append(l, v)
+		}
+	}
+	return l, nil
+}
+
+func (is *incomingTestStorage) AcknowledgeIncoming(ids []int64) error {
+	is.m.Lock()
+	defer is.m.Unlock()
+
+	for _, id := range ids {
+		for i := range is.msgs {
+			if is.msgs[i].Id == id {
+				is.msgs[i].Acknowledged = true
+			}
+		}
+	}
+	return nil
+}
+
+func (is *incomingTestStorage) LastIncomingId() (int64, error) {
+	is.m.Lock()
+	defer is.m.Unlock()
+
+	var last int64
+	for _, v := range is.msgs {
+		if v.Id > last {
+			last = v.Id
+		}
+	}
+	return last, nil
 }
@@ -0,0 +1,63 @@
+package gosmsc
+
+import (
+	"context"
+	"errors"
+	. "github.com/goodsign/gosmsc/contract"
+)
+
+var (
+	ErrNotSupported = errors.New("Not supported by the gateway client")
+)
+
+// sendContext sends sms using the context-aware func of the sender if it is supported. Otherwise
+// the context is checked only once before the plain Send call.
+func sendContext(ctx context.Context, sender Sender, phone string, text string) (*SendSMSResponse, error) {
+	if s, ok := sender.(SenderContext); ok {
+		return s.SendContext(ctx, phone, text)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return sender.Send(phone, text)
+}
+
+// sendWithOptionsContext sends sms with options if the sender supports them. Nil opts are sent using sendContext.
+func sendWithOptionsContext(ctx context.Context, sender Sender, phone string, text string, opts *SendOptions) (*SendSMSResponse, error) {
+	if opts == nil {
+		return sendContext(ctx, sender, phone, text)
+	}
+	if s, ok := sender.(SenderWithOptions); ok {
+		return s.SendWithOptionsContext(ctx, phone, text, opts)
+	}
+	return nil, ErrNotSupported
+}
+
+// fetchStatusContext fetches status using the context-aware func of the fetcher if it is supported. Otherwise
+// the context is checked only once before the plain FetchStatus call.
+func fetchStatusContext(ctx context.Context, fetcher StatusFetcher, id int64, phone string) (*CheckStatusResponse, error) {
+	if f, ok := fetcher.(StatusFetcherContext); ok {
+		return f.FetchStatusContext(ctx, id, phone)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fetcher.FetchStatus(id, phone)
+}
+
+// accountFetcher returns the sender as AccountFetcher if it supports account requests.
+func accountFetcher(sender Sender) (AccountFetcher, error) {
+	if f, ok := sender.(AccountFetcher); ok {
+		return f, nil
+	}
+	return nil, ErrNotSupported
+}
+
+// fetchMessageStatusContext fetches status of the tracked message from the gateway which sent it if the
+// fetcher routes messages across several gateways.
+func fetchMessageStatusContext(ctx context.Context, fetcher StatusFetcher, message *MessageStatus) (*CheckStatusResponse, error) {
+	if f, ok := fetcher.(GatewayStatusFetcher); ok && len(message.Gateway) != 0 {
+		return f.FetchGatewayStatusContext(ctx, message.Gateway, message.MessageId, message.Phone)
+	}
+	return fetchStatusContext(ctx, fetcher, message.MessageId, message.Phone)
+}